@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// Admin runs maintenance operations on kafka that don't require a running consumer
+type Admin struct {
+	client sarama.Client
+	admin  sarama.ClusterAdmin
+}
+
+// NewAdmin connects to kafka, listing all offsets of a consumer group requires kafka 0.10.2+
+func NewAdmin(kafkaServers []string) (*Admin, error) {
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_2_0
+	client, err := sarama.NewClient(kafkaServers, config)
+	if err != nil {
+		return nil, err
+	}
+	return newAdmin(client)
+}
+
+func newAdmin(client sarama.Client) (*Admin, error) {
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &Admin{client, admin}, nil
+}
+
+// CopyGroupOffsets commits the offsets committed by fromGroup for toGroup, so a renamed consumer group
+// continues where the old one stopped instead of replaying the topics. toGroup should not be running
+func (a *Admin) CopyGroupOffsets(fromGroup, toGroup string) error {
+	offsets, err := a.admin.ListConsumerGroupOffsets(fromGroup, nil)
+	if err != nil {
+		return err
+	}
+	if offsets.Err != sarama.ErrNoError {
+		return offsets.Err
+	}
+	request := &sarama.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           toGroup,
+		ConsumerGroupGeneration: sarama.GroupGenerationUndefined,
+		RetentionTime:           -1,
+	}
+	blocks := 0
+	for topic, partitions := range offsets.Blocks {
+		for partition, block := range partitions {
+			if block.Err != sarama.ErrNoError {
+				return block.Err
+			}
+			// partitions without a committed offset are left for toGroup's initial offset
+			if block.Offset < 0 {
+				continue
+			}
+			request.AddBlock(topic, partition, block.Offset, 0, block.Metadata)
+			blocks++
+		}
+	}
+	if blocks == 0 {
+		return nil
+	}
+	coordinator, err := a.client.Coordinator(toGroup)
+	if err != nil {
+		return err
+	}
+	response, err := coordinator.CommitOffset(request)
+	if err != nil {
+		return err
+	}
+	for _, partitions := range response.Errors {
+		for _, kerr := range partitions {
+			if kerr != sarama.ErrNoError {
+				return kerr
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Admin) Close() error {
+	return a.admin.Close()
+}
@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestAdmin_CopyGroupOffsets(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetController(broker.BrokerID()).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "old", broker).
+			SetCoordinator(sarama.CoordinatorGroup, "new", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("old", "test", 0, 42, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_2_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	admin, err := newAdmin(client)
+	if err != nil {
+		t.Fatalf("Error creating admin: %v", err)
+	}
+	defer admin.Close()
+	if err := admin.CopyGroupOffsets("old", "new"); err != nil {
+		t.Errorf("Error copying offsets: %v", err)
+	}
+	commits := 0
+	for _, rr := range broker.History() {
+		if request, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			commits++
+			if request.ConsumerGroup != "new" {
+				t.Errorf("Expected offsets to be committed for new, got %s", request.ConsumerGroup)
+			}
+		}
+	}
+	if commits != 1 {
+		t.Errorf("Expected a single offset commit, got %d", commits)
+	}
+}
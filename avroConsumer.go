@@ -1,27 +1,161 @@
 package kafka
 
 import (
+	"context"
 	"encoding/binary"
-	"os"
-	"os/signal"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/bsm/sarama-cluster"
 	"github.com/linkedin/goavro"
+	"github.com/rcrowley/go-metrics"
 )
 
+// clusterConsumer is the part of *cluster.Consumer the avro consumer relies on
+type clusterConsumer interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Errors() <-chan error
+	Notifications() <-chan *cluster.Notification
+	MarkOffset(msg *sarama.ConsumerMessage, metadata string)
+	MarkPartitionOffset(topic string, partition int32, offset int64, metadata string)
+	CommitOffsets() error
+	Close() error
+}
+
+// offsetResetter is the part of *cluster.Consumer that rewinds committed offsets, see ResetToEarliest
+type offsetResetter interface {
+	Subscriptions() map[string][]int32
+	ResetPartitionOffset(topic string, partition int32, offset int64, metadata string)
+}
+
+// offsetClient looks up the oldest and newest offsets of partitions, e.g. a sarama.Client
+type offsetClient interface {
+	GetOffset(topic string, partition int32, time int64) (int64, error)
+}
+
 type avroConsumer struct {
 	Consumer             *cluster.Consumer
 	SchemaRegistryClient *CachedSchemaRegistryClient
+	consumer             clusterConsumer
+	client               io.Closer
+	offsets              offsetClient
 	callbacks            ConsumerCallbacks
 	config               *cluster.Config
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	inFlight             int32
+	rebalances           int32
+	droppedNotifications int64
+	errorSummary         *errorSummary
+	groupId              string
+	vars                 *consumerVars
+	// consuming is held while Consume runs, draining is closed by Drain
+	consuming chan struct{}
+	draining  chan struct{}
+	drainOnce sync.Once
+
+	// CircuitBreaker pauses consumption when OnDataReceivedErr or OnDataReceivedCtx keep failing, disabled when nil.
+	// The message whose failure opened the circuit is held and processed again after every cooldown until it succeeds
+	CircuitBreaker CircuitBreaker
+	// LazyDecode defers decoding message values until Message.DecodedValue is called
+	LazyDecode bool
+	// ManualCommit stops Consume from marking every message, offsets only advance with MarkMessage and MarkOffsetForPartition
+	ManualCommit bool
+	// KeepRawMessage sets Message.Raw to the underlying sarama message
+	KeepRawMessage bool
+	// SingleObjectEncoding decodes values framed with avro's single object encoding as well, with the codecs
+	// of the registry client that match the fingerprint, see CachedSchemaRegistryClient.RegisterCodec
+	SingleObjectEncoding bool
+	// MaxInFlight processes up to MaxInFlight messages concurrently, Consume stops pulling from kafka while that many
+	// messages are being processed. Callbacks are then called from several goroutines, offsets are still marked
+	// in order per partition. Messages are processed one at a time when 0
+	MaxInFlight int
+	// EnumsAsStrings writes enums inside unions as the plain symbol, "ACTIVE" instead of {"test.Status": "ACTIVE"}.
+	// Record fields are written in alphabetical order then
+	EnumsAsStrings bool
+	// NullableUnions writes values of unions of null and a single other type as the plain value, e.g. "x" instead of
+	// {"string": "x"}, or leaves out null record fields as well. Record fields are written in alphabetical order then
+	NullableUnions NullableUnions
+	// MaxDepth rejects values whose records, arrays and maps are nested deeper, e.g. payloads of recursive schemas
+	// from untrusted producers, before they are decoded. There is no limit when 0
+	MaxDepth int
+	// StringTransform is applied to every avro string before the value is written as text, e.g. Latin1ToUTF8
+	// for legacy producers. Strings are passed through when nil
+	StringTransform func(s string) string
+	// AllowedSchemaIDs rejects messages with other schema ids with ErrSchemaNotAllowed before they are decoded
+	// or their schema is fetched, all schemas are accepted when nil. Single object encoding values are only accepted
+	// when their fingerprint is the one of a schema fetched by an allowed id before
+	AllowedSchemaIDs map[int]bool
+	// AllowedSubjects rejects messages whose schema isn't registered under one of the subjects with ErrSubjectNotAllowed
+	// before their schema is fetched, e.g. to skip unrelated record types on a shared topic. Consume reports them to
+	// OnError and marks them. All subjects are accepted when nil, single object encoding values are only accepted
+	// when their fingerprint is the one of a schema fetched by id before
+	AllowedSubjects []string
+	// BodyCompression decompresses avro bodies compressed like object container file blocks before they are decoded,
+	// e.g. topics carrying chunks of such files. Leave it empty for standard Confluent payloads
+	BodyCompression BodyCompression
+	// MaxDecompressedSize fails bodies that decompress to more bytes with ErrDecompressedTooLarge, so a small
+	// message can't exhaust memory. Defaults to 64 MiB
+	MaxDecompressedSize int
+	// RetryLadder republishes messages whose callback failed to retry topics and holds back consumed retries
+	// until their delay passed, disabled when nil. The ladder tracks attempts in headers, Consume fails unless
+	// the consumer config's Version is at least V0_11_0_0
+	RetryLadder *RetryLadder
+	// ErrorBuffer queues up to that many consumer errors for OnError so a slow handler doesn't stall the partition
+	// consumers until the queue is full, errors are never dropped. Errors are handed over directly when 0
+	ErrorBuffer int
+	// NotificationBuffer queues up to that many notifications for OnNotification, further notifications are dropped
+	// while the queue is full so a slow handler never stalls consuming, see DroppedNotifications.
+	// Notifications are handed over directly when 0
+	NotificationBuffer int
+	// ErrorSummaryInterval is how often OnErrorSummary is called, every minute when 0
+	ErrorSummaryInterval time.Duration
+	// IdleTimeout stops ConsumeN with ErrIdleTimeout when no message arrives for that long, ConsumeN waits forever when 0
+	IdleTimeout time.Duration
 }
 
 type ConsumerCallbacks struct {
 	OnDataReceived func(msg Message)
-	OnError        func(err error)
-	OnNotification func(notification *cluster.Notification)
+	// OnDataReceivedErr is like OnDataReceived but reports failures to OnError and the circuit breaker
+	OnDataReceivedErr func(msg Message) error
+	// OnDataReceivedCtx is like OnDataReceivedErr with a context that is cancelled when the consumer is closed
+	// and carries the message headers, see HeadersFromContext
+	OnDataReceivedCtx func(ctx context.Context, msg Message) error
+	OnError           func(err error)
+	OnNotification    func(notification *cluster.Notification)
+	// OnErrorSummary is called every ErrorSummaryInterval with the number of errors reported during the window,
+	// by the message of their cause, and when Consume or ConsumeN return. It isn't called for windows without errors.
+	// Errors are passed to OnError as well when both are set
+	OnErrorSummary func(counts map[string]int, window time.Duration)
+	// OnUnsupportedSchemaType receives messages with a schema that isn't avro instead of OnError,
+	// e.g. to forward them to another processor while a topic migrates to a different format
+	OnUnsupportedSchemaType func(m *sarama.ConsumerMessage, err *ErrUnsupportedSchemaType)
+	// OnCircuitOpen is called every time the circuit breaker pauses consumption
+	OnCircuitOpen func()
+	// OnCircuitClose is called when consumption recovered after the circuit was open
+	OnCircuitClose func()
+}
+
+// validate makes sure messages can't be consumed and marked without ever reaching the application
+func (callbacks ConsumerCallbacks) validate() error {
+	if callbacks.OnDataReceived == nil && callbacks.OnDataReceivedErr == nil && callbacks.OnDataReceivedCtx == nil {
+		return ErrMissingDataCallback
+	}
+	return nil
+}
+
+type headersContextKey struct{}
+
+// HeadersFromContext returns the headers of the message passed to OnDataReceivedCtx, e.g. to continue a trace
+func HeadersFromContext(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(headersContextKey{}).(map[string]string)
+	return headers
 }
 
 type Message struct {
@@ -34,6 +168,84 @@ type Message struct {
 
 	Headers   map[string]string
 	Timestamp time.Time // only set if kafka is version 0.10+, inner message timestamp
+
+	Raw *sarama.ConsumerMessage // only set if the consumer keeps raw messages
+
+	// Fingerprint is the writer schema fingerprint of values in single object encoding, SchemaId is 0 then
+	Fingerprint uint64
+
+	// UnionType is the branch of a top-level union schema the value was written with, e.g. "com.example.Created",
+	// it is empty for other schemas
+	UnionType string
+
+	lazy *lazyValue
+	// avroValue is the value as goavro decoded it when Value was simplified and simplifiedValue the Value
+	// it was simplified to, see ReEncode
+	avroValue       string
+	simplifiedValue string
+}
+
+// lazyValue defers decoding until the value is accessed, it is shared by all copies of a message
+type lazyValue struct {
+	once      sync.Once
+	decode    func() (string, string, error)
+	value     string
+	avroValue string
+	err       error
+}
+
+// DecodedValue returns the textual value of the message. With LazyDecode the value is decoded on the first call
+// and stored in Value, decode errors are returned here instead of being passed to OnError.
+// Copies of a message share the decoded result and can call DecodedValue from different goroutines,
+// a single Message value must not be shared between goroutines as Value is written to
+func (m *Message) DecodedValue() (string, error) {
+	if m.lazy == nil {
+		return m.Value, nil
+	}
+	m.lazy.once.Do(func() {
+		m.lazy.value, m.lazy.avroValue, m.lazy.err = m.lazy.decode()
+	})
+	if m.lazy.err == nil {
+		m.Value = m.lazy.value
+	}
+	return m.lazy.value, m.lazy.err
+}
+
+// ReEncode converts the textual value back to avro binary with the framing of the original message, the schema
+// registry framing or single object encoding for messages decoded by their Fingerprint. Values simplified by
+// EnumsAsStrings or NullableUnions can't be converted back, the value as goavro decoded it is encoded instead
+// and ErrSimplifiedValueChanged is returned when Value was changed. With LazyDecode the value is only decoded
+// when Value wasn't set yet, changes to a decoded Value are encoded
+func (m Message) ReEncode(codec *goavro.Codec) ([]byte, error) {
+	value := m.Value
+	if value == "" {
+		var err error
+		if value, err = m.DecodedValue(); err != nil {
+			return nil, err
+		}
+	}
+	avroValue, simplifiedValue := m.avroValue, m.simplifiedValue
+	if m.lazy != nil {
+		avroValue, simplifiedValue = m.lazy.avroValue, m.lazy.value
+	}
+	if avroValue != "" {
+		if value != simplifiedValue {
+			return nil, ErrSimplifiedValueChanged
+		}
+		value = avroValue
+	}
+	native, _, err := codec.NativeFromTextual([]byte(value))
+	if err != nil {
+		return nil, err
+	}
+	binaryValue, err := codec.BinaryFromNative(nil, native)
+	if err != nil {
+		return nil, err
+	}
+	if m.Fingerprint != 0 {
+		return encodeSingleObject(m.Fingerprint, binaryValue), nil
+	}
+	return encodeAvroMsg(m.SchemaId, binaryValue), nil
 }
 
 func NewDefaultConfig() *cluster.Config {
@@ -48,20 +260,58 @@ func NewDefaultConfig() *cluster.Config {
 // NewAvroConsumerWithConfig returns a basic consumer to interact with schema registry, avro and kafka and uses the passed in config
 func NewAvroConsumerWithConfig(kafkaServers []string, schemaRegistryServers []string,
 	topic string, groupId string, callbacks ConsumerCallbacks, config *cluster.Config) (*avroConsumer, error) {
+	return NewAvroConsumerWithConnectTimeout(kafkaServers, schemaRegistryServers, topic, groupId, callbacks, config, 0)
+}
+
+// NewAvroConsumerWithConnectTimeout is like NewAvroConsumerWithConfig but keeps trying to reach the kafka servers
+// for up to connectTimeout, e.g. when the consumer starts together with the cluster. Attempts are
+// config.Metadata.Retry.Backoff apart, see SetMetadataRetry. It gives up right away when connectTimeout is 0
+func NewAvroConsumerWithConnectTimeout(kafkaServers []string, schemaRegistryServers []string,
+	topic string, groupId string, callbacks ConsumerCallbacks, config *cluster.Config, connectTimeout time.Duration) (*avroConsumer, error) {
+	if err := callbacks.validate(); err != nil {
+		return nil, err
+	}
 	// init (custom) config, enable errors and notifications
 	topics := []string{topic}
-	consumer, err := cluster.NewConsumer(kafkaServers, groupId, topics, config)
+	var client *cluster.Client
+	err := connect(func() (err error) {
+		client, err = cluster.NewClient(kafkaServers, config)
+		return err
+	}, connectTimeout, config.Metadata.Retry.Backoff)
 	if err != nil {
 		return nil, err
 	}
+	warnUnsupportedHeaders(client.Client)
+	consumer, err := cluster.NewConsumerFromClient(client, groupId, topics)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
 
 	schemaRegistryClient := NewCachedSchemaRegistryClient(schemaRegistryServers)
-	return &avroConsumer{
-		consumer,
-		schemaRegistryClient,
-		callbacks,
-		config,
-	}, nil
+	ac := newAvroConsumer(consumer, schemaRegistryClient, callbacks, config)
+	ac.client = client
+	ac.offsets = client
+	ac.groupId = groupId
+	return ac, nil
+}
+
+func newAvroConsumer(consumer clusterConsumer, schemaRegistryClient *CachedSchemaRegistryClient,
+	callbacks ConsumerCallbacks, config *cluster.Config) *avroConsumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	ac := &avroConsumer{
+		SchemaRegistryClient: schemaRegistryClient,
+		consumer:             consumer,
+		callbacks:            callbacks,
+		config:               config,
+		ctx:                  ctx,
+		cancel:               cancel,
+		errorSummary:         newErrorSummary(),
+		consuming:            make(chan struct{}, 1),
+		draining:             make(chan struct{}),
+	}
+	ac.Consumer, _ = consumer.(*cluster.Consumer)
+	return ac
 }
 
 // NewAvroConsumer returns a basic consumer to interact with schema registry, avro and kafka
@@ -80,81 +330,832 @@ func (ac *avroConsumer) GetSchema(id int) (*goavro.Codec, error) {
 	return codec, nil
 }
 
-func (ac *avroConsumer) Consume() {
-	// trap SIGINT to trigger a shutdown.
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
+// Consume dispatches messages to the callbacks until the consumer is closed or the process receives SIGINT.
+// The signal is trapped once for the whole process, so a single SIGINT stops all running consumers.
+// It returns an error when the consumer reports a fatal error, see IsFatal, restarting won't help then
+func (ac *avroConsumer) Consume() error {
+	if ac.RetryLadder != nil && !ac.config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		// older versions don't fetch headers, every failure would be republished to the first step again
+		return sarama.ConfigurationError("RetryLadder requires Version >= V0_11_0_0")
+	}
+	ac.consuming <- struct{}{}
+	defer func() { <-ac.consuming }()
+	interrupted, unsubscribe := interrupts.subscribe()
+	defer unsubscribe()
+	defer ac.startErrorSummaries()()
 
+	fatal := make(chan error, 1)
 	if ac.config.Consumer.Return.Errors {
 		// consume errors
+		errs := ac.consumer.Errors()
+		if ac.ErrorBuffer > 0 {
+			errs = bufferErrors(errs, ac.ErrorBuffer)
+		}
 		go func() {
-			for err := range ac.Consumer.Errors() {
-				if ac.callbacks.OnError != nil {
-					ac.callbacks.OnError(err)
+			for err := range errs {
+				if IsFatal(err) {
+					select {
+					case fatal <- err:
+					default:
+					}
+					continue
 				}
+				ac.reportError(err)
 			}
 		}()
 	}
 
 	if ac.config.Group.Return.Notifications {
 		// consume notifications
-		go func() {
-			for notification := range ac.Consumer.Notifications() {
-				if ac.callbacks.OnNotification != nil {
-					ac.callbacks.OnNotification(notification)
+		go ac.consumeNotifications()
+	}
+
+	if ac.MaxInFlight > 0 {
+		return ac.consumeConcurrently(interrupted, fatal)
+	}
+
+	for {
+		select {
+		case m, ok := <-ac.consumer.Messages():
+			if !ok {
+				return nil
+			}
+			if !ac.awaitRetry(m, interrupted) {
+				return nil
+			}
+			atomic.AddInt32(&ac.inFlight, 1)
+			err := ac.processMessage(m)
+			if cooldown := ac.updateCircuit(err); cooldown > 0 {
+				var passed bool
+				if passed, err = ac.holdMessage(m, cooldown, interrupted); !passed {
+					atomic.AddInt32(&ac.inFlight, -1)
+					return nil
 				}
 			}
-		}()
+			if !ac.retryFailed(m, err, interrupted) {
+				atomic.AddInt32(&ac.inFlight, -1)
+				return nil
+			}
+			if !ac.ManualCommit {
+				ac.consumer.MarkOffset(m, "")
+			}
+			atomic.AddInt32(&ac.inFlight, -1)
+		case err := <-fatal:
+			return err
+		case <-interrupted:
+			return nil
+		case <-ac.ctx.Done():
+			return nil
+		case <-ac.draining:
+			return nil
+		}
+	}
+}
+
+// CommitAll synchronously commits the marked offsets of every topic and partition, e.g. with ManualCommit
+// as a checkpoint across topics that are processed together
+func (ac *avroConsumer) CommitAll() error {
+	return ac.consumer.CommitOffsets()
+}
+
+// ResetToEarliest moves the committed offsets of all assigned partitions back to the oldest message kafka still holds
+// and commits them, so the backlog is consumed again after a restart. Partitions keep being consumed from where they
+// are and offsets marked later override the reset, call it after Drain or before Consume
+func (ac *avroConsumer) ResetToEarliest() error {
+	return ac.resetOffsets(sarama.OffsetOldest)
+}
+
+// ResetToLatest moves the committed offsets of all assigned partitions to the end and commits them, so the backlog is
+// skipped after a restart. Like ResetToEarliest, call it after Drain or before Consume
+func (ac *avroConsumer) ResetToLatest() error {
+	return ac.resetOffsets(sarama.OffsetNewest)
+}
+
+func (ac *avroConsumer) resetOffsets(position int64) error {
+	consumer, ok := ac.consumer.(offsetResetter)
+	if !ok || ac.offsets == nil {
+		return ErrOffsetResetUnsupported
 	}
+	for topic, partitions := range consumer.Subscriptions() {
+		for _, partition := range partitions {
+			offset, err := ac.offsets.GetOffset(topic, partition, position)
+			if err != nil {
+				return err
+			}
+			// offsets are marked as processed, the committed offset is the one of the next message
+			if position == sarama.OffsetOldest {
+				consumer.ResetPartitionOffset(topic, partition, offset-1, "")
+			} else {
+				ac.consumer.MarkPartitionOffset(topic, partition, offset-1, "")
+			}
+		}
+	}
+	return ac.consumer.CommitOffsets()
+}
 
+// Drain stops Consume from pulling messages, waits for the messages being processed to finish, then processes
+// the messages that are already buffered and commits, e.g. before Close in a deploy. sarama-cluster can't pause
+// partitions, they keep fetching until Close and messages that arrive after the buffer was emptied are consumed again
+// by the next owner of their partition. Consume returns right away once the consumer is drained.
+// It returns ctx.Err() when ctx is done first
+func (ac *avroConsumer) Drain(ctx context.Context) error {
+	ac.drainOnce.Do(func() { close(ac.draining) })
+	select {
+	case ac.consuming <- struct{}{}:
+		defer func() { <-ac.consuming }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	for {
 		select {
-		case m, ok := <-ac.Consumer.Messages():
-			if ok {
-				msg, err := ac.ProcessAvroMsg(m)
-				if err != nil {
-					ac.callbacks.OnError(err)
-				} else {
-					if ac.callbacks.OnDataReceived != nil {
-						ac.callbacks.OnDataReceived(msg)
-					}
+		case m, ok := <-ac.consumer.Messages():
+			if !ok {
+				return ac.consumer.CommitOffsets()
+			}
+			atomic.AddInt32(&ac.inFlight, 1)
+			if !ac.retryFailed(m, ac.processMessage(m), nil) {
+				// the consumer is draining, the message is consumed again by the next owner of its partition
+				atomic.AddInt32(&ac.inFlight, -1)
+				return ac.consumer.CommitOffsets()
+			}
+			if !ac.ManualCommit {
+				ac.consumer.MarkOffset(m, "")
+			}
+			atomic.AddInt32(&ac.inFlight, -1)
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			return ac.consumer.CommitOffsets()
+		}
+	}
+}
+
+// ConsumeN passes the next n decoded messages to handler instead of the data callbacks and marks them unless
+// ManualCommit is set. Messages that fail to decode are reported to OnError, marked the same way and not counted.
+// The marked offsets are committed before it returns, whatever the reason. It returns ErrIdleTimeout when IdleTimeout
+// passes without a message and io.EOF when the consumer is closed
+func (ac *avroConsumer) ConsumeN(n int, handler func(msg Message)) (err error) {
+	defer ac.startErrorSummaries()()
+	defer func() {
+		// the error that stopped consumption is more important than one of the commit
+		if commitErr := ac.consumer.CommitOffsets(); commitErr != nil && (err == nil || err == ErrIdleTimeout) {
+			err = commitErr
+		}
+	}()
+	errs, notifications := ac.consumer.Errors(), ac.consumer.Notifications()
+	for n > 0 {
+		var idle <-chan time.Time
+		if ac.IdleTimeout > 0 {
+			idle = time.After(ac.IdleTimeout)
+		}
+		select {
+		case m, ok := <-ac.consumer.Messages():
+			if !ok {
+				return io.EOF
+			}
+			if msg, err := ac.ProcessAvroMsg(m); err != nil {
+				ac.reportError(err)
+			} else {
+				handler(msg)
+				n--
+			}
+			if !ac.ManualCommit {
+				ac.consumer.MarkOffset(m, "")
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+			} else if IsFatal(err) {
+				return err
+			} else {
+				ac.reportError(err)
+			}
+		case notification, ok := <-notifications:
+			if !ok {
+				notifications = nil
+			} else {
+				ac.handleNotification(notification)
+			}
+		case <-idle:
+			return ErrIdleTimeout
+		case <-ac.ctx.Done():
+			return io.EOF
+		}
+	}
+	return nil
+}
+
+// consumeConcurrently hands messages to at most MaxInFlight goroutines and waits for them before returning
+func (ac *avroConsumer) consumeConcurrently(interrupted <-chan struct{}, fatal <-chan error) error {
+	slots := make(chan struct{}, ac.MaxInFlight)
+	// every held message keeps its slot, so sending never blocks
+	held := make(chan heldMessage, ac.MaxInFlight)
+	tracker := newOffsetTracker()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// finish marks a processed message, unless the consumer stopped before it was handed to the retry ladder.
+	// Its tracker entry is kept then, so no later offset of the partition is marked either
+	finish := func(m *sarama.ConsumerMessage, tracked *trackedMessage, err error) bool {
+		retried := ac.retryFailed(m, err, interrupted)
+		if retried && tracked != nil {
+			tracker.done(tracked, func(m *sarama.ConsumerMessage) { ac.consumer.MarkOffset(m, "") })
+		}
+		atomic.AddInt32(&ac.inFlight, -1)
+		<-slots
+		return retried
+	}
+	// release tests a held message while no other message is fetched
+	release := func(h heldMessage) bool {
+		passed, err := ac.holdMessage(h.msg, h.cooldown, interrupted)
+		return passed && finish(h.msg, h.tracked, err)
+	}
+
+	for {
+		select {
+		case slots <- struct{}{}:
+		case h := <-held:
+			if !release(h) {
+				return nil
+			}
+			continue
+		case err := <-fatal:
+			return err
+		case <-interrupted:
+			return nil
+		case <-ac.ctx.Done():
+			return nil
+		case <-ac.draining:
+			return nil
+		}
+
+		select {
+		case m, ok := <-ac.consumer.Messages():
+			if !ok {
+				return nil
+			}
+			if !ac.awaitRetry(m, interrupted) {
+				return nil
+			}
+			var tracked *trackedMessage
+			if !ac.ManualCommit {
+				// with ManualCommit the callbacks mark offsets themselves, nothing has to be tracked
+				tracked = tracker.add(m)
+			}
+			wg.Add(1)
+			atomic.AddInt32(&ac.inFlight, 1)
+			go func() {
+				defer wg.Done()
+				err := ac.processMessage(m)
+				if cooldown := ac.updateCircuit(err); cooldown > 0 {
+					held <- heldMessage{msg: m, tracked: tracked, cooldown: cooldown}
+					return
 				}
-				ac.Consumer.MarkOffset(m, "")
+				finish(m, tracked, err)
+			}()
+		case h := <-held:
+			<-slots
+			if !release(h) {
+				return nil
 			}
-		case <-signals:
-			return
+		case err := <-fatal:
+			return err
+		case <-interrupted:
+			return nil
+		case <-ac.ctx.Done():
+			return nil
+		case <-ac.draining:
+			return nil
+		}
+	}
+}
+
+func (ac *avroConsumer) handleNotification(notification *cluster.Notification) {
+	ac.trackNotification(notification)
+	if ac.callbacks.OnNotification != nil {
+		ac.callbacks.OnNotification(notification)
+	}
+}
+
+func (ac *avroConsumer) trackNotification(notification *cluster.Notification) {
+	switch notification.Type {
+	case cluster.RebalanceStart:
+		ac.warnUncommitted()
+	case cluster.RebalanceOK:
+		atomic.AddInt32(&ac.rebalances, 1)
+	}
+}
+
+// consumeNotifications hands notifications over to OnNotification, through a queue of NotificationBuffer
+// notifications when set
+func (ac *avroConsumer) consumeNotifications() {
+	if ac.NotificationBuffer <= 0 || ac.callbacks.OnNotification == nil {
+		for notification := range ac.consumer.Notifications() {
+			ac.handleNotification(notification)
+		}
+		return
+	}
+	queue := make(chan *cluster.Notification, ac.NotificationBuffer)
+	defer close(queue)
+	go func() {
+		for notification := range queue {
+			ac.callbacks.OnNotification(notification)
+		}
+	}()
+	for notification := range ac.consumer.Notifications() {
+		ac.trackNotification(notification)
+		select {
+		case queue <- notification:
+		default:
+			ac.dropNotification(notification)
+		}
+	}
+}
+
+const droppedNotificationsMetric = "go-kafka-avro-dropped-notifications"
+
+func (ac *avroConsumer) dropNotification(notification *cluster.Notification) {
+	atomic.AddInt64(&ac.droppedNotifications, 1)
+	if ac.config != nil && ac.config.MetricRegistry != nil {
+		metrics.GetOrRegisterCounter(droppedNotificationsMetric, ac.config.MetricRegistry).Inc(1)
+	}
+	Logger.Printf("dropped %s notification, OnNotification is too slow", notification.Type)
+}
+
+// DroppedNotifications returns the number of notifications dropped because the NotificationBuffer was full.
+// The count is also reported as the "go-kafka-avro-dropped-notifications" counter of Config.MetricRegistry
+func (ac *avroConsumer) DroppedNotifications() int64 {
+	return atomic.LoadInt64(&ac.droppedNotifications)
+}
+
+// bufferErrors forwards errs to a channel that holds up to size errors
+func bufferErrors(errs <-chan error, size int) <-chan error {
+	buffered := make(chan error, size)
+	go func() {
+		defer close(buffered)
+		for err := range errs {
+			buffered <- err
+		}
+	}()
+	return buffered
+}
+
+// RebalanceCount returns the number of rebalances the consumer completed, it changes whenever partitions are
+// reassigned so work started before a rebalance can be fenced off. It is a local count, not the generation id of
+// the group coordinator which sarama-cluster doesn't expose, and requires Group.Return.Notifications and a running Consume
+func (ac *avroConsumer) RebalanceCount() int32 {
+	return atomic.LoadInt32(&ac.rebalances)
+}
+
+// warnUncommitted logs when messages are still being processed as a rebalance starts, sarama-cluster already
+// committed and their offsets are lost, see CommitBeforeRevoke
+func (ac *avroConsumer) warnUncommitted() {
+	if n := atomic.LoadInt32(&ac.inFlight); n > 0 {
+		Logger.Printf("%d messages were still being processed when the group rebalanced, they will be consumed again. "+
+			"Raise Group.Offsets.Synchronization.DwellTime with CommitBeforeRevoke", n)
+	}
+}
+
+// pause stops consumption for the circuit breaker cooldown or a retry delay, it returns false when the consumer has to stop
+func (ac *avroConsumer) pause(cooldown time.Duration, interrupted <-chan struct{}) bool {
+	select {
+	case <-time.After(cooldown):
+		return true
+	case <-interrupted:
+		return false
+	case <-ac.ctx.Done():
+		return false
+	case <-ac.draining:
+		return false
+	}
+}
+
+// processMessage decodes and dispatches a message, the returned error is the one of the data callback.
+// It is reported, handing the message to the retry ladder is up to the caller, see retryFailed
+func (ac *avroConsumer) processMessage(m *sarama.ConsumerMessage) error {
+	msg, err := ac.ProcessAvroMsg(m)
+	if err != nil {
+		if unsupported, ok := err.(*ErrUnsupportedSchemaType); ok && ac.callbacks.OnUnsupportedSchemaType != nil {
+			ac.callbacks.OnUnsupportedSchemaType(m, unsupported)
+		} else {
+			ac.reportError(err)
+		}
+		return nil
+	}
+	if ac.callbacks.OnDataReceived != nil {
+		ac.callbacks.OnDataReceived(msg)
+	}
+	if ac.callbacks.OnDataReceivedErr != nil {
+		if err := ac.callbacks.OnDataReceivedErr(msg); err != nil {
+			ac.reportError(err)
+			return err
+		}
+	}
+	if ac.callbacks.OnDataReceivedCtx != nil {
+		ctx := context.WithValue(ac.ctx, headersContextKey{}, msg.Headers)
+		if err := ac.callbacks.OnDataReceivedCtx(ctx, msg); err != nil {
+			ac.reportError(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// retryFailed hands a message whose callback failed with err to the retry ladder, it does nothing when err is nil.
+// When the message can't be republished it tries again every RetryLadder.Backoff, the message must not be marked
+// before. It returns false when the consumer has to stop first, the message is consumed again after a restart then
+func (ac *avroConsumer) retryFailed(m *sarama.ConsumerMessage, err error, interrupted <-chan struct{}) bool {
+	if err == nil || ac.RetryLadder == nil {
+		return true
+	}
+	for {
+		err := ac.RetryLadder.Retry(m)
+		if err == nil {
+			return true
+		}
+		ac.reportError(err)
+		if !ac.pause(ac.RetryLadder.backoff(), interrupted) {
+			return false
+		}
+	}
+}
+
+// heldMessage is a message whose failure opened the circuit breaker, it is processed again after cooldown
+type heldMessage struct {
+	msg      *sarama.ConsumerMessage
+	tracked  *trackedMessage
+	cooldown time.Duration
+}
+
+// holdMessage processes the message whose failure opened the circuit breaker again as the test message once the
+// cooldown passed, until the circuit lets it through, so it is neither marked nor retried while the circuit is open.
+// It returns the error of the last attempt, and false when the consumer has to stop first, the message is left
+// unmarked then and consumed again after a restart
+func (ac *avroConsumer) holdMessage(m *sarama.ConsumerMessage, cooldown time.Duration, interrupted <-chan struct{}) (bool, error) {
+	var err error
+	for cooldown > 0 {
+		if !ac.pause(cooldown, interrupted) {
+			return false, nil
+		}
+		err = ac.processMessage(m)
+		cooldown = ac.updateCircuit(err)
+	}
+	return true, err
+}
+
+// awaitRetry holds back a retried message until its delay passed, it returns false when the consumer has to stop
+func (ac *avroConsumer) awaitRetry(m *sarama.ConsumerMessage, interrupted <-chan struct{}) bool {
+	if ac.RetryLadder == nil {
+		return true
+	}
+	if delay := ac.RetryLadder.delay(m); delay > 0 {
+		return ac.pause(delay, interrupted)
+	}
+	return true
+}
+
+// updateCircuit records the callback result and returns how long consumption has to pause
+func (ac *avroConsumer) updateCircuit(err error) time.Duration {
+	if ac.CircuitBreaker == nil {
+		return 0
+	}
+	if err == nil {
+		if ac.CircuitBreaker.Success() && ac.callbacks.OnCircuitClose != nil {
+			ac.callbacks.OnCircuitClose()
 		}
+		return 0
+	}
+	if !ac.CircuitBreaker.Failure() {
+		return 0
+	}
+	if ac.callbacks.OnCircuitOpen != nil {
+		ac.callbacks.OnCircuitOpen()
+	}
+	return ac.CircuitBreaker.Cooldown()
+}
+
+func (ac *avroConsumer) reportError(err error) {
+	if ac.callbacks.OnError != nil {
+		ac.callbacks.OnError(err)
 	}
+	if ac.callbacks.OnErrorSummary != nil {
+		ac.errorSummary.add(err)
+	}
+}
+
+// MarkMessage marks the message as processed, its offset is committed with the next commit
+func (ac *avroConsumer) MarkMessage(msg Message) {
+	ac.MarkOffsetForPartition(msg.Topic, msg.Partition, msg.Offset)
+}
+
+// MarkOffsetForPartition marks the offset of the topic/partition and every offset before it as processed
+func (ac *avroConsumer) MarkOffsetForPartition(topic string, partition int32, offset int64) {
+	ac.consumer.MarkPartitionOffset(topic, partition, offset, "")
 }
 
+// ProcessAvroMsg decodes a kafka message, tombstones (messages without a value) are returned with an empty Value
 func (ac *avroConsumer) ProcessAvroMsg(m *sarama.ConsumerMessage) (Message, error) {
-	schemaId := binary.BigEndian.Uint32(m.Value[1:5])
-	codec, err := ac.GetSchema(int(schemaId))
+	msg, err := ac.processAvroMsg(m)
+	if ac.vars != nil {
+		ac.vars.count(m.Value, err)
+	}
+	return msg, err
+}
+
+func (ac *avroConsumer) processAvroMsg(m *sarama.ConsumerMessage) (Message, error) {
+	if len(m.Value) == 0 {
+		return ac.newMessage(m, 0), nil
+	}
+	if ac.SingleObjectEncoding && hasSingleObjectMarker(m.Value) {
+		return ac.processSingleObjectMsg(m)
+	}
+	schemaId, err := ParseSchemaID(m.Value)
 	if err != nil {
+		return Message{}, &DecodeError{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Err: err}
+	}
+	if schemaId == 0 {
+		return Message{}, &DecodeError{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Err: ErrZeroSchemaId}
+	}
+	if err := ac.checkAllowed(m, schemaId); err != nil {
 		return Message{}, err
 	}
-	// Convert binary Avro data back to native Go form
-	native, _, err := codec.NativeFromBinary(m.Value[5:])
+	codec, err := ac.GetSchema(schemaId)
 	if err != nil {
 		return Message{}, err
 	}
+	return ac.decodeMessage(m, schemaId, codec)
+}
 
-	// Convert native Go form to textual Avro data
-	textual, err := codec.TextualFromNative(nil, native)
+// checkAllowed fails when the schema id isn't one of the AllowedSchemaIDs or isn't registered under any of the AllowedSubjects
+func (ac *avroConsumer) checkAllowed(m *sarama.ConsumerMessage, schemaId int) error {
+	if ac.AllowedSchemaIDs != nil && !ac.AllowedSchemaIDs[schemaId] {
+		return &DecodeError{SchemaId: schemaId, Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Err: ErrSchemaNotAllowed}
+	}
+	if ac.AllowedSubjects != nil {
+		allowed, err := ac.subjectAllowed(schemaId)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return &DecodeError{SchemaId: schemaId, Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Err: ErrSubjectNotAllowed}
+		}
+	}
+	return nil
+}
+
+// subjectAllowed reports whether the schema is registered under one of the AllowedSubjects
+func (ac *avroConsumer) subjectAllowed(schemaId int) (bool, error) {
+	subjects, err := ac.SchemaRegistryClient.GetSubjectsBySchemaId(schemaId)
+	if err != nil {
+		return false, err
+	}
+	for _, subject := range subjects {
+		for _, allowed := range ac.AllowedSubjects {
+			if subject == allowed {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
 
+func (ac *avroConsumer) processSingleObjectMsg(m *sarama.ConsumerMessage) (Message, error) {
+	fingerprint := singleObjectFingerprint(m.Value)
+	codec, ok := ac.SchemaRegistryClient.GetCodecByFingerprint(fingerprint)
+	if !ok {
+		return Message{}, &DecodeError{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Err: ErrUnknownFingerprint}
+	}
+	if ac.AllowedSchemaIDs != nil || ac.AllowedSubjects != nil {
+		// values are only checked by the id of their schema, which is unknown for codecs registered by hand
+		schemaId, ok := ac.SchemaRegistryClient.schemaIdByFingerprint(fingerprint)
+		if !ok {
+			cause := ErrSchemaNotAllowed
+			if ac.AllowedSchemaIDs == nil {
+				cause = ErrSubjectNotAllowed
+			}
+			return Message{}, &DecodeError{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Err: cause}
+		}
+		if err := ac.checkAllowed(m, schemaId); err != nil {
+			return Message{}, err
+		}
+	}
+	msg, err := ac.decodeMessage(m, 0, codec)
 	if err != nil {
 		return Message{}, err
 	}
-	msg := Message{int(schemaId), m.Topic, m.Partition, m.Offset, string(m.Key), string(textual), nil, m.Timestamp}
+	msg.Fingerprint = fingerprint
+	return msg, nil
+}
+
+func (ac *avroConsumer) decodeMessage(m *sarama.ConsumerMessage, schemaId int, codec *goavro.Codec) (Message, error) {
+	var err error
+	msg := ac.newMessage(m, schemaId)
+	if ac.BodyCompression != "" {
+		value, err := decompressValue(m.Value, ac.BodyCompression, ac.MaxDecompressedSize)
+		if err != nil {
+			return Message{}, &DecodeError{SchemaId: schemaId, Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Err: err}
+		}
+		decompressed := *m
+		decompressed.Value = value
+		m = &decompressed
+	}
+	msg.UnionType = ac.unionBranch(m, schemaId, codec)
+	if ac.LazyDecode {
+		msg.lazy = &lazyValue{decode: func() (string, string, error) { return ac.decodeValue(m, schemaId, codec) }}
+	} else if msg.Value, msg.avroValue, err = ac.decodeValue(m, schemaId, codec); err != nil {
+		return Message{}, err
+	} else if msg.avroValue != "" {
+		msg.simplifiedValue = msg.Value
+	}
+	return msg, nil
+}
+
+// decodeValue returns the textual value of the message in the output format of the consumer, and the value as goavro
+// decoded it when the consumer simplified it, goavro can't convert simplified values back
+func (ac *avroConsumer) decodeValue(m *sarama.ConsumerMessage, schemaId int, codec *goavro.Codec) (string, string, error) {
+	if ac.MaxDepth > 0 {
+		if err := ac.checkDepth(m, schemaId, codec); err != nil {
+			return "", "", err
+		}
+	}
+	value, err := ac.decodeAvroValue(m, schemaId, codec)
+	if err != nil || (!ac.EnumsAsStrings && ac.NullableUnions == NullableUnionsWrapped) {
+		return value, "", err
+	}
+	schema, err := ac.parsedSchema(m, schemaId, codec)
+	if err != nil {
+		return "", "", newDecodeError(m, schemaId, nil, err)
+	}
+	var native interface{}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&native); err != nil {
+		return "", "", newDecodeError(m, schemaId, nil, err)
+	}
+	var simplified strings.Builder
+	encoder := json.NewEncoder(&simplified)
+	// keep strings as goavro writes them
+	encoder.SetEscapeHTML(false)
+	if ac.EnumsAsStrings {
+		native = schema.unwrapEnums(native)
+	}
+	if ac.NullableUnions != NullableUnionsWrapped {
+		native = schema.flattenNullable(native, ac.NullableUnions == NullableUnionsOmitted)
+	}
+	if err := encoder.Encode(native); err != nil {
+		return "", "", newDecodeError(m, schemaId, nil, err)
+	}
+	return strings.TrimSuffix(simplified.String(), "\n"), value, nil
+}
+
+// ParseSchemaID returns the schema id of a value framed by the schema registry serializers, without fetching the schema
+// or decoding the value. It fails with ErrShortValue or ErrInvalidMagicByte for values that aren't framed that way
+func ParseSchemaID(value []byte) (int, error) {
+	if len(value) < 5 {
+		return 0, ErrShortValue
+	}
+	if value[0] != 0 {
+		return 0, ErrInvalidMagicByte
+	}
+	return int(binary.BigEndian.Uint32(value[1:5])), nil
+}
+
+// DecodeAll decodes a value holding several avro records back to back after a single schema registry framing,
+// all records are decoded with the schema id of the framing
+func (ac *avroConsumer) DecodeAll(value []byte) ([]Message, error) {
+	schemaId, err := ParseSchemaID(value)
+	if err != nil {
+		return nil, err
+	}
+	if schemaId == 0 {
+		return nil, &DecodeError{Err: ErrZeroSchemaId}
+	}
+	codec, err := ac.GetSchema(schemaId)
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	for remaining := value[5:]; len(remaining) > 0; {
+		native, rest, err := codec.NativeFromBinary(remaining)
+		if err != nil {
+			return nil, &DecodeError{SchemaId: schemaId, Err: fmt.Errorf("record %d: %s", len(messages), err)}
+		}
+		if len(rest) == len(remaining) {
+			return nil, &DecodeError{SchemaId: schemaId, Err: ErrEmptyRecord}
+		}
+		remaining = rest
+		textual, err := codec.TextualFromNative(nil, native)
+		if err != nil {
+			return nil, &DecodeError{SchemaId: schemaId, Err: fmt.Errorf("record %d: %s", len(messages), err)}
+		}
+		messages = append(messages, Message{SchemaId: schemaId, Value: string(textual)})
+	}
+	return messages, nil
+}
+
+// newMessage copies everything but the value of the kafka message
+func (ac *avroConsumer) newMessage(m *sarama.ConsumerMessage, schemaId int) Message {
+	msg := Message{SchemaId: schemaId, Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Key: string(m.Key), Timestamp: m.Timestamp}
+	if ac.KeepRawMessage {
+		msg.Raw = m
+	}
 	if m.Headers != nil {
 		msg.Headers = make(map[string]string)
 		for _, v := range m.Headers {
 			msg.Headers[string(v.Key)] = string(v.Value)
 		}
 	}
-	return msg, nil
+	return msg
+}
+
+// parsedSchema returns the parsed schema of the codec the message is decoded with, cached by the registry client
+// under the schema id, or under the fingerprint for values in single object encoding which have no id
+func (ac *avroConsumer) parsedSchema(m *sarama.ConsumerMessage, schemaId int, codec *goavro.Codec) (*avroSchema, error) {
+	var fingerprint uint64
+	if schemaId == 0 {
+		fingerprint = singleObjectFingerprint(m.Value)
+	}
+	return ac.SchemaRegistryClient.parsedSchema(schemaId, fingerprint, codec)
+}
+
+// decodeAvroValue converts the binary avro value of a message to its textual form, applying StringTransform
+// to every string when set
+func (ac *avroConsumer) decodeAvroValue(m *sarama.ConsumerMessage, schemaId int, codec *goavro.Codec) (string, error) {
+	// Convert binary Avro data back to native Go form
+	native, _, err := codec.NativeFromBinary(avroBody(m.Value))
+	if err != nil {
+		return "", newDecodeError(m, schemaId, codec, err)
+	}
+
+	if ac.StringTransform != nil {
+		schema, err := ac.parsedSchema(m, schemaId, codec)
+		if err != nil {
+			return "", newDecodeError(m, schemaId, nil, err)
+		}
+		native = schema.transformStrings(native, ac.StringTransform)
+	}
+
+	// Convert native Go form to textual Avro data
+	textual, err := codec.TextualFromNative(nil, native)
+
+	if err != nil {
+		return "", newDecodeError(m, schemaId, nil, err)
+	}
+	return string(textual), nil
+}
+
+// checkDepth fails when the value is nested deeper than MaxDepth, malformed values are left to the decoder
+func (ac *avroConsumer) checkDepth(m *sarama.ConsumerMessage, schemaId int, codec *goavro.Codec) error {
+	schema, err := ac.parsedSchema(m, schemaId, codec)
+	if err != nil {
+		return newDecodeError(m, schemaId, nil, err)
+	}
+	if path, err := schema.checkDepth(avroBody(m.Value), ac.MaxDepth); err == ErrMaxDepthExceeded {
+		decodeErr := newDecodeError(m, schemaId, nil, err)
+		decodeErr.Field = path
+		return decodeErr
+	}
+	return nil
+}
+
+// unionBranch returns the name of the branch a value of a top-level union schema was written with,
+// read from the branch index that prefixes the binary value
+func (ac *avroConsumer) unionBranch(m *sarama.ConsumerMessage, schemaId int, codec *goavro.Codec) string {
+	if !strings.HasPrefix(codec.Schema(), "[") {
+		return ""
+	}
+	schema, err := ac.parsedSchema(m, schemaId, codec)
+	if err != nil {
+		return ""
+	}
+	index, _, err := readVarint(avroBody(m.Value))
+	if err != nil || index < 0 || index >= int64(len(schema.Branches)) {
+		return ""
+	}
+	return schema.Branches[index].typeName()
+}
+
+// newDecodeError wraps a decode failure, when the codec is given it walks the data to find the offending field
+func newDecodeError(m *sarama.ConsumerMessage, schemaId int, codec *goavro.Codec, err error) *DecodeError {
+	decodeErr := &DecodeError{SchemaId: schemaId, Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Err: err}
+	if codec != nil {
+		if schema, parseErr := parseAvroSchema(codec.Schema()); parseErr == nil {
+			if _, path, walkErr := schema.skipBinary(avroBody(m.Value), ""); walkErr != nil {
+				decodeErr.Field = path
+			}
+		}
+	}
+	return decodeErr
 }
 
 func (ac *avroConsumer) Close() error {
-	return ac.Consumer.Close()
+	ac.cancel()
+	err := ac.consumer.Close()
+	if ac.client != nil {
+		// the consumer doesn't close clients it was created from
+		if clientErr := ac.client.Close(); err == nil {
+			err = clientErr
+		}
+	}
+	return err
 }
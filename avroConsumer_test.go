@@ -1,10 +1,26 @@
 package kafka
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
 	"github.com/linkedin/goavro"
+	"github.com/rcrowley/go-metrics"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var testData = `{"val":1}`
@@ -28,7 +44,7 @@ func TestAvroConsumer_ProcessAvroMsg(t *testing.T) {
 	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
 	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
 	callbacks := &ConsumerCallbacks{}
-	avroConsumer := &avroConsumer{nil, schemaRegistryMock, *callbacks}
+	avroConsumer := &avroConsumer{SchemaRegistryClient: schemaRegistryMock, callbacks: *callbacks}
 	consumerMsg := &sarama.ConsumerMessage{
 		Value:     getTestAvroMsg(t, schemaRegistryTestObject.Codec),
 		Key:       []byte("key"),
@@ -44,3 +60,1099 @@ func TestAvroConsumer_ProcessAvroMsg(t *testing.T) {
 		t.Errorf("Wrong data")
 	}
 }
+
+func TestMessage_ReEncode(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	msg := Message{SchemaId: 1, Topic: "test", Value: testData}
+	binaryMsg, err := msg.ReEncode(schemaRegistryTestObject.Codec)
+	if err != nil {
+		t.Errorf("Error re-encoding msg: %v", err)
+	}
+	if !bytes.Equal(binaryMsg, getTestAvroMsg(t, schemaRegistryTestObject.Codec)) {
+		t.Errorf("Wrong encoding, got %v", binaryMsg)
+	}
+	msg = Message{Fingerprint: 42, Topic: "test", Value: testData}
+	if binaryMsg, err = msg.ReEncode(schemaRegistryTestObject.Codec); err != nil {
+		t.Errorf("Error re-encoding msg: %v", err)
+	}
+	if !hasSingleObjectMarker(binaryMsg) || singleObjectFingerprint(binaryMsg) != 42 || !bytes.Equal(binaryMsg[10:], []byte{2}) {
+		t.Errorf("Expected single object encoding, got %v", binaryMsg)
+	}
+}
+
+func TestMessage_ReEncodeLazy(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	defer schemaRegistryTestObject.MockServer.Close()
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.LazyDecode = true
+	value := getTestAvroMsg(t, schemaRegistryTestObject.Codec)
+	msg, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: value})
+	if err != nil {
+		t.Fatalf("Error process avro msg: %v", err)
+	}
+	if binaryMsg, err := msg.ReEncode(schemaRegistryTestObject.Codec); err != nil || !bytes.Equal(binaryMsg, value) {
+		t.Errorf("Expected the value to be decoded and re-encoded, got %v: %v", binaryMsg, err)
+	}
+	if _, err := msg.DecodedValue(); err != nil {
+		t.Fatalf("Error decoding value: %v", err)
+	}
+	msg.Value = `{"val":7}`
+	binaryMsg, err := msg.ReEncode(schemaRegistryTestObject.Codec)
+	if err != nil {
+		t.Fatalf("Error re-encoding msg: %v", err)
+	}
+	expected, _ := (Message{SchemaId: 1, Value: `{"val":7}`}).ReEncode(schemaRegistryTestObject.Codec)
+	if !bytes.Equal(binaryMsg, expected) {
+		t.Errorf("Expected the edited value to be encoded, got %v", binaryMsg)
+	}
+}
+
+func TestNewAvroConsumer_MissingDataCallback(t *testing.T) {
+	callbacks := ConsumerCallbacks{
+		OnError: func(err error) {},
+	}
+	_, err := NewAvroConsumer([]string{"localhost:9092"}, []string{"http://localhost:8081"}, "test", "group", callbacks)
+	if err != ErrMissingDataCallback {
+		t.Errorf("Expected error %v, got %v", ErrMissingDataCallback, err)
+	}
+}
+
+func TestAvroConsumer_CircuitBreaker(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	opened, closed := 0, 0
+	downstreamErr := errors.New("downstream unavailable")
+	failing := true
+	callbacks := ConsumerCallbacks{
+		OnDataReceivedErr: func(msg Message) error {
+			if failing {
+				return downstreamErr
+			}
+			return nil
+		},
+		OnCircuitOpen:  func() { opened++ },
+		OnCircuitClose: func() { closed++ },
+	}
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, callbacks, nil)
+	avroConsumer.CircuitBreaker = NewCircuitBreaker(2, time.Second)
+	consumerMsg := &sarama.ConsumerMessage{
+		Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+		Topic: "test",
+	}
+	if cooldown := avroConsumer.updateCircuit(avroConsumer.processMessage(consumerMsg)); cooldown != 0 {
+		t.Errorf("Expected no pause after the first failure, got %s", cooldown)
+	}
+	if cooldown := avroConsumer.updateCircuit(avroConsumer.processMessage(consumerMsg)); cooldown != time.Second {
+		t.Errorf("Expected pause of %s, got %s", time.Second, cooldown)
+	}
+	failing = false
+	if cooldown := avroConsumer.updateCircuit(avroConsumer.processMessage(consumerMsg)); cooldown != 0 {
+		t.Errorf("Expected no pause after recovery, got %s", cooldown)
+	}
+	if opened != 1 || closed != 1 {
+		t.Errorf("Expected circuit to open and close once, got %d opened and %d closed", opened, closed)
+	}
+}
+
+func TestAvroConsumer_CircuitBreakerHoldsMessage(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	for _, maxInFlight := range []int{0, 1} {
+		var attempts []int64
+		var lock sync.Mutex
+		received := make(chan struct{}, 10)
+		callbacks := ConsumerCallbacks{OnDataReceivedErr: func(msg Message) error {
+			lock.Lock()
+			defer lock.Unlock()
+			attempts = append(attempts, msg.Offset)
+			received <- struct{}{}
+			if len(attempts) < 3 {
+				return errors.New("downstream unavailable")
+			}
+			return nil
+		}}
+		mockConsumer := newMockClusterConsumer()
+		avroConsumer := newAvroConsumer(mockConsumer, schemaRegistryMock, callbacks, NewDefaultConfig())
+		avroConsumer.CircuitBreaker = NewCircuitBreaker(1, 10*time.Millisecond)
+		avroConsumer.MaxInFlight = maxInFlight
+		done := make(chan struct{})
+		go func() {
+			avroConsumer.Consume()
+			close(done)
+		}()
+		for offset := int64(0); offset < 2; offset++ {
+			mockConsumer.messages <- &sarama.ConsumerMessage{
+				Value:  getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+				Topic:  "test",
+				Offset: offset,
+			}
+		}
+		for i := 0; i < 4; i++ {
+			<-received
+		}
+		avroConsumer.Close()
+		<-done
+		if !reflect.DeepEqual(attempts, []int64{0, 0, 0, 1}) {
+			t.Errorf("MaxInFlight %d: expected offset 0 to be held until it succeeded, got attempts %v", maxInFlight, attempts)
+		}
+		var marked []int64
+		for _, m := range mockConsumer.marked {
+			marked = append(marked, m.Offset)
+		}
+		if !reflect.DeepEqual(marked, []int64{0, 1}) {
+			t.Errorf("MaxInFlight %d: expected offsets 0 and 1 to be marked once they succeeded, got %v", maxInFlight, marked)
+		}
+	}
+}
+
+func TestAvroConsumer_OnDataReceivedCtx(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	var received context.Context
+	callbacks := ConsumerCallbacks{
+		OnDataReceivedCtx: func(ctx context.Context, msg Message) error {
+			received = ctx
+			return nil
+		},
+	}
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, callbacks, nil)
+	consumerMsg := &sarama.ConsumerMessage{
+		Value:   getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+		Topic:   "test",
+		Headers: []*sarama.RecordHeader{{Key: []byte("traceparent"), Value: []byte("00-abc-def-01")}},
+	}
+	if err := avroConsumer.processMessage(consumerMsg); err != nil {
+		t.Errorf("Error processing msg: %v", err)
+	}
+	if HeadersFromContext(received)["traceparent"] != "00-abc-def-01" {
+		t.Errorf("Expected headers in callback context, got %v", HeadersFromContext(received))
+	}
+	avroConsumer.cancel()
+	if received.Err() != context.Canceled {
+		t.Errorf("Expected callback context to be cancelled with the consumer")
+	}
+}
+
+func TestAvroConsumer_ProcessAvroMsgDecodeError(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	value := getTestAvroMsg(t, schemaRegistryTestObject.Codec)
+	consumerMsg := &sarama.ConsumerMessage{
+		Value:  append(value[:5], 0x80),
+		Topic:  "test",
+		Offset: 42,
+	}
+	_, err := avroConsumer.ProcessAvroMsg(consumerMsg)
+	decodeErr, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("Expected a decode error, got %v", err)
+	}
+	if decodeErr.SchemaId != 1 || decodeErr.Offset != 42 || decodeErr.Field != "val" {
+		t.Errorf("Unexpected decode error details: %v", decodeErr)
+	}
+}
+
+type mockClusterConsumer struct {
+	messages      chan *sarama.ConsumerMessage
+	errors        chan error
+	notifications chan *cluster.Notification
+	marked        []*sarama.ConsumerMessage
+	commits       int
+	lock          sync.Mutex
+}
+
+func newMockClusterConsumer() *mockClusterConsumer {
+	return &mockClusterConsumer{
+		messages:      make(chan *sarama.ConsumerMessage, 10),
+		errors:        make(chan error, 10),
+		notifications: make(chan *cluster.Notification, 10),
+	}
+}
+
+func (c *mockClusterConsumer) Messages() <-chan *sarama.ConsumerMessage    { return c.messages }
+func (c *mockClusterConsumer) Errors() <-chan error                        { return c.errors }
+func (c *mockClusterConsumer) Notifications() <-chan *cluster.Notification { return c.notifications }
+
+func (c *mockClusterConsumer) MarkOffset(msg *sarama.ConsumerMessage, metadata string) {
+	c.lock.Lock()
+	c.marked = append(c.marked, msg)
+	c.lock.Unlock()
+}
+
+func (c *mockClusterConsumer) MarkPartitionOffset(topic string, partition int32, offset int64, metadata string) {
+	c.MarkOffset(&sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: offset}, metadata)
+}
+
+func (c *mockClusterConsumer) CommitOffsets() error {
+	c.lock.Lock()
+	c.commits++
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *mockClusterConsumer) Close() error {
+	close(c.messages)
+	close(c.errors)
+	close(c.notifications)
+	return nil
+}
+
+func TestAvroConsumer_ConsumeSharedInterrupt(t *testing.T) {
+	callbacks := ConsumerCallbacks{OnDataReceived: func(msg Message) {}}
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		avroConsumer := newAvroConsumer(newMockClusterConsumer(), nil, callbacks, NewDefaultConfig())
+		defer avroConsumer.Close()
+		go func() {
+			avroConsumer.Consume()
+			done <- struct{}{}
+		}()
+	}
+	for start := time.Now(); interrupts.count() < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Consumers did not start")
+		}
+	}
+	process, _ := os.FindProcess(os.Getpid())
+	if err := process.Signal(os.Interrupt); err != nil {
+		t.Skipf("Cannot send interrupt: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected both consumers to stop on a single interrupt, %d stopped", i)
+		}
+	}
+}
+
+func TestAvroConsumer_LazyDecode(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.LazyDecode = true
+	consumerMsg := &sarama.ConsumerMessage{
+		Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+		Topic: "test",
+	}
+	msg, err := avroConsumer.ProcessAvroMsg(consumerMsg)
+	if err != nil {
+		t.Errorf("Error process avro msg: %v", err)
+	}
+	if msg.Value != "" {
+		t.Errorf("Expected value not to be decoded yet, got %s", msg.Value)
+	}
+	copied := msg
+	value, err := copied.DecodedValue()
+	if err != nil {
+		t.Errorf("Error decoding value: %v", err)
+	}
+	if value != testData || copied.Value != testData {
+		t.Errorf("Wrong data")
+	}
+	if value, _ := msg.DecodedValue(); value != testData {
+		t.Errorf("Expected copies to share the decoded value")
+	}
+}
+
+func TestAvroConsumer_ManualCommit(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	received := make(chan Message, 1)
+	callbacks := ConsumerCallbacks{OnDataReceived: func(msg Message) { received <- msg }}
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, schemaRegistryMock, callbacks, NewDefaultConfig())
+	avroConsumer.ManualCommit = true
+	done := make(chan struct{})
+	go func() {
+		avroConsumer.Consume()
+		close(done)
+	}()
+	mockConsumer.messages <- &sarama.ConsumerMessage{
+		Value:     getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+		Topic:     "test",
+		Partition: 2,
+		Offset:    7,
+	}
+	msg := <-received
+	avroConsumer.Close()
+	<-done
+	if len(mockConsumer.marked) != 0 {
+		t.Errorf("Expected no offsets to be marked automatically, got %d", len(mockConsumer.marked))
+	}
+	avroConsumer.MarkMessage(msg)
+	if len(mockConsumer.marked) != 1 || mockConsumer.marked[0].Partition != 2 || mockConsumer.marked[0].Offset != 7 {
+		t.Errorf("Expected offset 7 of partition 2 to be marked, got %v", mockConsumer.marked)
+	}
+}
+
+func TestAvroConsumer_ManualCommitMaxInFlight(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	received := make(chan Message, 3)
+	callbacks := ConsumerCallbacks{OnDataReceived: func(msg Message) { received <- msg }}
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, schemaRegistryMock, callbacks, NewDefaultConfig())
+	avroConsumer.ManualCommit = true
+	avroConsumer.MaxInFlight = 2
+	done := make(chan struct{})
+	go func() {
+		avroConsumer.Consume()
+		close(done)
+	}()
+	for offset := int64(0); offset < 3; offset++ {
+		mockConsumer.messages <- &sarama.ConsumerMessage{
+			Value:  getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+			Topic:  "test",
+			Offset: offset,
+		}
+	}
+	for i := 0; i < 3; i++ {
+		<-received
+	}
+	avroConsumer.Close()
+	<-done
+	if len(mockConsumer.marked) != 0 {
+		t.Errorf("Expected no offsets to be marked automatically, got %d", len(mockConsumer.marked))
+	}
+}
+
+func TestAvroConsumer_ProcessAvroMsgZeroSchemaId(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	consumerMsg := &sarama.ConsumerMessage{
+		Value: []byte{0, 0, 0, 0, 0, 2},
+		Topic: "test",
+	}
+	_, err := avroConsumer.ProcessAvroMsg(consumerMsg)
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrZeroSchemaId {
+		t.Errorf("Expected zero schema id error, got %v", err)
+	}
+	if schemaRegistryTestObject.Count != 0 {
+		t.Errorf("Expected no schema registry call, got %d", schemaRegistryTestObject.Count)
+	}
+}
+
+func TestAvroConsumer_OnUnsupportedSchemaType(t *testing.T) {
+	var requests int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"schema": "{\"type\": \"object\"}", "schemaType": "JSON"}`)
+	}))
+	defer mockServer.Close()
+	var unsupported *ErrUnsupportedSchemaType
+	callbacks := ConsumerCallbacks{
+		OnDataReceived: func(msg Message) {
+			t.Errorf("Expected message not to be dispatched")
+		},
+		OnError: func(err error) {
+			t.Errorf("Expected error not to be reported: %v", err)
+		},
+		OnUnsupportedSchemaType: func(m *sarama.ConsumerMessage, err *ErrUnsupportedSchemaType) {
+			unsupported = err
+		},
+	}
+	avroConsumer := newAvroConsumer(nil, NewCachedSchemaRegistryClient([]string{mockServer.URL}), callbacks, nil)
+	consumerMsg := &sarama.ConsumerMessage{
+		Value: append([]byte{0, 0, 0, 0, 2}, `{"val": 1}`...),
+		Topic: "test",
+	}
+	avroConsumer.processMessage(consumerMsg)
+	if unsupported == nil || unsupported.SchemaType != "JSON" {
+		t.Errorf("Expected unsupported JSON schema, got %v", unsupported)
+	}
+	unsupported = nil
+	avroConsumer.processMessage(consumerMsg)
+	if unsupported == nil || atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("Expected the unsupported schema type to be cached, got %d requests", atomic.LoadInt32(&requests))
+	}
+}
+
+func TestAvroConsumer_KeepRawMessage(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	consumerMsg := &sarama.ConsumerMessage{
+		Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+		Topic: "test",
+	}
+	if msg, _ := avroConsumer.ProcessAvroMsg(consumerMsg); msg.Raw != nil {
+		t.Errorf("Expected raw message not to be kept by default")
+	}
+	avroConsumer.KeepRawMessage = true
+	if msg, _ := avroConsumer.ProcessAvroMsg(consumerMsg); msg.Raw != consumerMsg {
+		t.Errorf("Expected raw message to be kept")
+	}
+}
+
+func TestAvroConsumer_DecodeAll(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	value := getTestAvroMsg(t, schemaRegistryTestObject.Codec)
+	value = append(value, value[5:]...)
+	messages, err := avroConsumer.DecodeAll(value)
+	if err != nil {
+		t.Fatalf("Error decoding records: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(messages))
+	}
+	for _, msg := range messages {
+		if msg.Value != testData || msg.SchemaId != 1 {
+			t.Errorf("Wrong data")
+		}
+	}
+	if _, err := avroConsumer.DecodeAll([]byte{0, 0}); err != ErrShortValue {
+		t.Errorf("Expected ErrShortValue, got %v", err)
+	}
+	codec, err := goavro.NewCodec(`"null"`)
+	if err != nil {
+		t.Fatalf("Error creating codec: %v", err)
+	}
+	schemaRegistryMock.schemaCache[2] = codec
+	if _, err := avroConsumer.DecodeAll([]byte{0, 0, 0, 0, 2, 1}); err == nil || err.(*DecodeError).Err != ErrEmptyRecord {
+		t.Errorf("Expected ErrEmptyRecord, got %v", err)
+	}
+}
+
+func TestAvroConsumer_MaxInFlight(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	received := make(chan Message, 3)
+	release := []chan struct{}{make(chan struct{}), make(chan struct{}), make(chan struct{})}
+	callbacks := ConsumerCallbacks{OnDataReceived: func(msg Message) {
+		received <- msg
+		<-release[msg.Offset]
+	}}
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, schemaRegistryMock, callbacks, NewDefaultConfig())
+	avroConsumer.MaxInFlight = 2
+	done := make(chan struct{})
+	go func() {
+		avroConsumer.Consume()
+		close(done)
+	}()
+	for offset := int64(0); offset < 3; offset++ {
+		mockConsumer.messages <- &sarama.ConsumerMessage{
+			Value:  getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+			Topic:  "test",
+			Offset: offset,
+		}
+	}
+	<-received
+	<-received
+	select {
+	case msg := <-received:
+		t.Fatalf("Expected at most 2 messages in flight, received offset %d", msg.Offset)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release[1])
+	close(release[0])
+	if msg := <-received; msg.Offset != 2 {
+		t.Errorf("Expected offset 2, got %d", msg.Offset)
+	}
+	close(release[2])
+	avroConsumer.Close()
+	<-done
+	var marked []int64
+	for _, m := range mockConsumer.marked {
+		marked = append(marked, m.Offset)
+	}
+	if len(marked) == 0 || marked[len(marked)-1] != 2 {
+		t.Errorf("Expected offset 2 to be marked last, got %v", marked)
+	}
+	for i := 1; i < len(marked); i++ {
+		if marked[i] <= marked[i-1] {
+			t.Errorf("Expected offsets to be marked in order, got %v", marked)
+		}
+	}
+}
+
+func TestAvroConsumer_UnionType(t *testing.T) {
+	codec, err := goavro.NewCodec(`[{"type": "record", "name": "Created", "namespace": "test.ns", "fields": [{"name": "val", "type": "int"}]},
+		{"type": "record", "name": "Deleted", "namespace": "test.ns", "fields": [{"name": "val", "type": "int"}]}]`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{"http://localhost"})
+	schemaRegistryMock.schemaCache[2] = codec
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	binaryValue, err := codec.BinaryFromNative(nil, goavro.Union("test.ns.Deleted", map[string]interface{}{"val": 1}))
+	if err != nil {
+		t.Fatalf("Error get binary from native: %v", err)
+	}
+	msg, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: encodeAvroMsg(2, binaryValue), Topic: "test"})
+	if err != nil {
+		t.Errorf("Error process avro msg: %v", err)
+	}
+	if msg.UnionType != "test.ns.Deleted" {
+		t.Errorf("Expected union type test.ns.Deleted, got %q", msg.UnionType)
+	}
+}
+
+func TestAvroConsumer_ConsumeFatalError(t *testing.T) {
+	var reported []error
+	callbacks := ConsumerCallbacks{
+		OnDataReceived: func(msg Message) {},
+		OnError:        func(err error) { reported = append(reported, err) },
+	}
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, nil, callbacks, NewDefaultConfig())
+	defer avroConsumer.Close()
+	mockConsumer.errors <- sarama.ErrRequestTimedOut
+	mockConsumer.errors <- &sarama.ConsumerError{Topic: "test", Err: sarama.ErrTopicAuthorizationFailed}
+	err := avroConsumer.Consume()
+	consumerErr, ok := err.(*sarama.ConsumerError)
+	if !ok || consumerErr.Err != sarama.ErrTopicAuthorizationFailed {
+		t.Errorf("Expected Consume to return the authorization failure, got %v", err)
+	}
+	if len(reported) != 1 || reported[0] != sarama.ErrRequestTimedOut {
+		t.Errorf("Expected only the transient error to be reported, got %v", reported)
+	}
+}
+
+func TestAvroConsumer_ConsumeN(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, schemaRegistryMock, ConsumerCallbacks{}, NewDefaultConfig())
+	defer avroConsumer.Close()
+	avroConsumer.IdleTimeout = 50 * time.Millisecond
+	for offset := int64(0); offset < 3; offset++ {
+		mockConsumer.messages <- &sarama.ConsumerMessage{
+			Value:  getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+			Topic:  "test",
+			Offset: offset,
+		}
+	}
+	var received []Message
+	handler := func(msg Message) { received = append(received, msg) }
+	if err := avroConsumer.ConsumeN(2, handler); err != nil {
+		t.Errorf("Error consuming messages: %v", err)
+	}
+	if len(received) != 2 || len(mockConsumer.marked) != 2 || mockConsumer.commits != 1 {
+		t.Errorf("Expected 2 messages to be handled, marked and committed, got %d, %d, %d commits",
+			len(received), len(mockConsumer.marked), mockConsumer.commits)
+	}
+	if err := avroConsumer.ConsumeN(2, handler); err != ErrIdleTimeout {
+		t.Errorf("Expected ErrIdleTimeout, got %v", err)
+	}
+	if len(received) != 3 || mockConsumer.commits != 2 {
+		t.Errorf("Expected the last message to be handled and committed, got %d, %d commits", len(received), mockConsumer.commits)
+	}
+}
+
+func TestAvroConsumer_ConsumeNCommitsOnError(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, schemaRegistryMock, ConsumerCallbacks{}, NewDefaultConfig())
+	avroConsumer.ManualCommit = true
+	mockConsumer.messages <- &sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec), Topic: "test"}
+	handler := func(msg Message) {
+		avroConsumer.MarkMessage(msg)
+		mockConsumer.errors <- sarama.ErrTopicAuthorizationFailed
+	}
+	if err := avroConsumer.ConsumeN(2, handler); err != sarama.ErrTopicAuthorizationFailed {
+		t.Errorf("Expected the fatal error, got %v", err)
+	}
+	if len(mockConsumer.marked) != 1 || mockConsumer.commits != 1 {
+		t.Errorf("Expected only the manual mark to be committed, got %d marks and %d commits", len(mockConsumer.marked), mockConsumer.commits)
+	}
+	avroConsumer.Close()
+	if err := avroConsumer.ConsumeN(1, handler); err != io.EOF || mockConsumer.commits != 2 {
+		t.Errorf("Expected io.EOF and a commit once the consumer is closed, got %v and %d commits", err, mockConsumer.commits)
+	}
+}
+
+func TestIsFatal(t *testing.T) {
+	tests := []struct {
+		err   error
+		fatal bool
+	}{
+		{sarama.ErrTopicAuthorizationFailed, true},
+		{&sarama.ConsumerError{Err: sarama.ErrInvalidTopic}, true},
+		{sarama.ErrUnknownTopicOrPartition, false},
+		{errors.New(sarama.ErrTopicAuthorizationFailed.Error()), false},
+	}
+	for _, test := range tests {
+		if fatal := IsFatal(test.err); fatal != test.fatal {
+			t.Errorf("Expected IsFatal(%v) to be %t", test.err, test.fatal)
+		}
+	}
+	// sarama-cluster errors wrap the kafka error in an unexported field, they are matched by the message
+	if !isFatalMessage(sarama.ErrGroupAuthorizationFailed.Error()) || isFatalMessage(sarama.ErrUnknownTopicOrPartition.Error()) {
+		t.Errorf("Expected only the messages of fatal errors to be fatal")
+	}
+}
+
+func TestAvroConsumer_EnumsAsStrings(t *testing.T) {
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "test", "fields": [
+		{"name": "status", "type": ["null", {"type": "enum", "name": "status", "symbols": ["NEW", "DONE"]}]}]}`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{"http://localhost"})
+	schemaRegistryMock.schemaCache[2] = codec
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.EnumsAsStrings = true
+	binaryValue, err := codec.BinaryFromNative(nil, map[string]interface{}{"status": goavro.Union("status", "DONE")})
+	if err != nil {
+		t.Fatalf("Error get binary from native: %v", err)
+	}
+	msg, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: encodeAvroMsg(2, binaryValue)})
+	if err != nil {
+		t.Errorf("Error process avro msg: %v", err)
+	}
+	if msg.Value != `{"status":"DONE"}` {
+		t.Errorf(`Expected {"status":"DONE"}, got %s`, msg.Value)
+	}
+}
+
+func TestAvroConsumer_RebalanceWithMessagesInFlight(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	logger := &testLogger{}
+	previous := Logger
+	defer func() { Logger = previous }()
+	Logger = logger
+	received := make(chan Message)
+	release := make(chan struct{})
+	notified := make(chan struct{})
+	callbacks := ConsumerCallbacks{
+		OnDataReceived: func(msg Message) {
+			received <- msg
+			<-release
+		},
+		OnNotification: func(notification *cluster.Notification) { notified <- struct{}{} },
+	}
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, schemaRegistryMock, callbacks, NewDefaultConfig())
+	avroConsumer.MaxInFlight = 2
+	done := make(chan struct{})
+	go func() {
+		avroConsumer.Consume()
+		close(done)
+	}()
+	mockConsumer.messages <- &sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec), Topic: "test"}
+	<-received
+	// sarama-cluster already committed when it sends the notification, the pending mark misses the commit
+	mockConsumer.notifications <- &cluster.Notification{Type: cluster.RebalanceStart}
+	<-notified
+	close(release)
+	avroConsumer.Close()
+	<-done
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "1 messages were still being processed") {
+		t.Errorf("Expected a warning about the message in flight, got %v", logger.lines)
+	}
+	if len(mockConsumer.marked) != 1 {
+		t.Errorf("Expected the message to be marked once processed, got %d", len(mockConsumer.marked))
+	}
+}
+
+func TestAvroConsumer_MaxDepth(t *testing.T) {
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "node", "fields": [{"name": "next", "type": ["null", "node"]}]}`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	node := map[string]interface{}{"next": nil}
+	for i := 0; i < 5; i++ {
+		node = map[string]interface{}{"next": goavro.Union("node", node)}
+	}
+	binaryValue, err := codec.BinaryFromNative(nil, node)
+	if err != nil {
+		t.Fatalf("Error get binary from native: %v", err)
+	}
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{"http://localhost"})
+	schemaRegistryMock.schemaCache[2] = codec
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.MaxDepth = 3
+	_, err = avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: encodeAvroMsg(2, binaryValue)})
+	decodeErr, ok := err.(*DecodeError)
+	if !ok || decodeErr.Err != ErrMaxDepthExceeded || decodeErr.Field != "next.next.next" {
+		t.Errorf("Expected ErrMaxDepthExceeded at next.next.next, got %v", err)
+	}
+	avroConsumer.MaxDepth = 10
+	if _, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: encodeAvroMsg(2, binaryValue)}); err != nil {
+		t.Errorf("Error process avro msg: %v", err)
+	}
+}
+
+func TestAvroConsumer_CommitAll(t *testing.T) {
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, nil, ConsumerCallbacks{}, NewDefaultConfig())
+	defer avroConsumer.Close()
+	avroConsumer.MarkOffsetForPartition("orders", 0, 4)
+	avroConsumer.MarkOffsetForPartition("payments", 1, 9)
+	if err := avroConsumer.CommitAll(); err != nil {
+		t.Errorf("Error committing offsets: %v", err)
+	}
+	if mockConsumer.commits != 1 || len(mockConsumer.marked) != 2 {
+		t.Errorf("Expected both marks to be committed at once, got %d commits", mockConsumer.commits)
+	}
+}
+
+func TestAvroConsumer_StringTransform(t *testing.T) {
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "test", "fields": [
+		{"name": "name", "type": "string"}, {"name": "alias", "type": ["null", "string"]}]}`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	binaryValue, err := codec.BinaryFromNative(nil, map[string]interface{}{"name": "caf\xe9", "alias": goavro.Union("string", "na\xefve")})
+	if err != nil {
+		t.Fatalf("Error get binary from native: %v", err)
+	}
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{"http://localhost"})
+	schemaRegistryMock.schemaCache[2] = codec
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.StringTransform = Latin1ToUTF8
+	msg, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: encodeAvroMsg(2, binaryValue)})
+	if err != nil {
+		t.Errorf("Error process avro msg: %v", err)
+	}
+	var value struct {
+		Name  string
+		Alias struct{ String string }
+	}
+	if err := json.Unmarshal([]byte(msg.Value), &value); err != nil {
+		t.Errorf("Error parsing value: %v", err)
+	}
+	if value.Name != "café" || value.Alias.String != "naïve" {
+		t.Errorf("Expected strings converted to UTF-8, got %s", msg.Value)
+	}
+}
+
+func TestAvroConsumer_RebalanceCount(t *testing.T) {
+	notified := make(chan struct{})
+	callbacks := ConsumerCallbacks{
+		OnDataReceived: func(msg Message) {},
+		OnNotification: func(notification *cluster.Notification) { notified <- struct{}{} },
+	}
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, nil, callbacks, NewDefaultConfig())
+	done := make(chan struct{})
+	go func() {
+		avroConsumer.Consume()
+		close(done)
+	}()
+	for _, notificationType := range []cluster.NotificationType{cluster.RebalanceStart, cluster.RebalanceOK, cluster.RebalanceStart, cluster.RebalanceOK} {
+		mockConsumer.notifications <- &cluster.Notification{Type: notificationType}
+		<-notified
+	}
+	if rebalances := avroConsumer.RebalanceCount(); rebalances != 2 {
+		t.Errorf("Expected 2 rebalances, got %d", rebalances)
+	}
+	avroConsumer.Close()
+	<-done
+}
+
+func TestAvroConsumer_AllowedSchemaIDs(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.AllowedSchemaIDs = map[int]bool{2: true}
+	consumerMsg := &sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec), Topic: "test"}
+	_, err := avroConsumer.ProcessAvroMsg(consumerMsg)
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrSchemaNotAllowed || decodeErr.SchemaId != 1 {
+		t.Errorf("Expected ErrSchemaNotAllowed, got %v", err)
+	}
+	if schemaRegistryTestObject.Count != 0 {
+		t.Errorf("Expected the schema not to be fetched, got %d requests", schemaRegistryTestObject.Count)
+	}
+	avroConsumer.AllowedSchemaIDs[1] = true
+	if _, err := avroConsumer.ProcessAvroMsg(consumerMsg); err != nil {
+		t.Errorf("Error process avro msg: %v", err)
+	}
+}
+
+func TestAvroConsumer_NotificationBuffer(t *testing.T) {
+	started, release, received := make(chan struct{}, 1), make(chan struct{}), make(chan struct{})
+	callbacks := ConsumerCallbacks{
+		OnDataReceived: func(msg Message) { close(received) },
+		OnNotification: func(notification *cluster.Notification) {
+			started <- struct{}{}
+			<-release
+		},
+	}
+	mockConsumer := newMockClusterConsumer()
+	config := NewDefaultConfig()
+	avroConsumer := newAvroConsumer(mockConsumer, nil, callbacks, config)
+	avroConsumer.NotificationBuffer = 1
+	done := make(chan struct{})
+	go func() {
+		avroConsumer.Consume()
+		close(done)
+	}()
+	mockConsumer.notifications <- &cluster.Notification{Type: cluster.RebalanceStart}
+	<-started
+	for _, notificationType := range []cluster.NotificationType{cluster.RebalanceOK, cluster.RebalanceStart, cluster.RebalanceOK} {
+		mockConsumer.notifications <- &cluster.Notification{Type: notificationType}
+	}
+	for deadline := time.Now().Add(time.Second); avroConsumer.DroppedNotifications() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if dropped := avroConsumer.DroppedNotifications(); dropped != 2 {
+		t.Errorf("Expected 2 dropped notifications, got %d", dropped)
+	}
+	if counted := metrics.GetOrRegisterCounter(droppedNotificationsMetric, config.MetricRegistry).Count(); counted != 2 {
+		t.Errorf("Expected the metric to count 2 dropped notifications, got %d", counted)
+	}
+	if rebalances := avroConsumer.RebalanceCount(); rebalances != 2 {
+		t.Errorf("Expected dropped notifications to be tracked, got %d rebalances", rebalances)
+	}
+	mockConsumer.messages <- &sarama.ConsumerMessage{Topic: "test"}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Errorf("Expected messages to be consumed while OnNotification is blocked")
+	}
+	close(release)
+	avroConsumer.Close()
+	<-done
+}
+
+func TestBufferErrors(t *testing.T) {
+	errs := make(chan error)
+	buffered := bufferErrors(errs, 2)
+	for i := 0; i < 3; i++ {
+		select {
+		case errs <- fmt.Errorf("error %d", i):
+		case <-time.After(time.Second):
+			t.Fatalf("Expected error %d to be forwarded", i)
+		}
+	}
+	close(errs)
+	var received []string
+	for err := range buffered {
+		received = append(received, err.Error())
+	}
+	if !reflect.DeepEqual(received, []string{"error 0", "error 1", "error 2"}) {
+		t.Errorf("Expected every error in order, got %v", received)
+	}
+}
+
+func TestParseSchemaID(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+		id    int
+		err   error
+	}{
+		{"framed", []byte{0, 0, 0, 1, 2, 6}, 258, nil},
+		{"framing only", []byte{0, 0, 0, 0, 7}, 7, nil},
+		{"short", []byte{0, 0, 0, 1}, 0, ErrShortValue},
+		{"magic byte", []byte{1, 0, 0, 0, 7, 6}, 0, ErrInvalidMagicByte},
+	}
+	for _, test := range tests {
+		id, err := ParseSchemaID(test.value)
+		if id != test.id || err != test.err {
+			t.Errorf("%s: expected %d, %v, got %d, %v", test.name, test.id, test.err, id, err)
+		}
+	}
+}
+
+func TestAvroConsumer_ProcessAvroMsgInvalidFraming(t *testing.T) {
+	avroConsumer := newAvroConsumer(nil, nil, ConsumerCallbacks{}, nil)
+	_, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: []byte{0, 1}, Topic: "test", Offset: 3})
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrShortValue || decodeErr.Offset != 3 {
+		t.Errorf("Expected ErrShortValue, got %v", err)
+	}
+}
+
+func TestAvroConsumer_Drain(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var received int32
+	callbacks := ConsumerCallbacks{OnDataReceived: func(msg Message) {
+		if atomic.AddInt32(&received, 1) == 1 {
+			close(started)
+			<-release
+		}
+	}}
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, nil, callbacks, NewDefaultConfig())
+	consumed := make(chan error)
+	go func() { consumed <- avroConsumer.Consume() }()
+	mockConsumer.messages <- &sarama.ConsumerMessage{Topic: "test", Offset: 1}
+	<-started
+	mockConsumer.messages <- &sarama.ConsumerMessage{Topic: "test", Offset: 2}
+	mockConsumer.messages <- &sarama.ConsumerMessage{Topic: "test", Offset: 3}
+	drained := make(chan error)
+	go func() { drained <- avroConsumer.Drain(context.Background()) }()
+	select {
+	case err := <-drained:
+		t.Fatalf("Expected Drain to wait for the message being processed, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-drained; err != nil {
+		t.Errorf("Error draining: %v", err)
+	}
+	if err := <-consumed; err != nil {
+		t.Errorf("Expected Consume to return after Drain, got %v", err)
+	}
+	mockConsumer.lock.Lock()
+	marked, commits := len(mockConsumer.marked), mockConsumer.commits
+	mockConsumer.lock.Unlock()
+	if n := atomic.LoadInt32(&received); n != 3 || marked != 3 || commits != 1 {
+		t.Errorf("Expected the buffered messages to be handled, marked and committed, got %d, %d, %d commits", n, marked, commits)
+	}
+	if err := avroConsumer.Consume(); err != nil {
+		t.Errorf("Expected Consume to return right away once drained, got %v", err)
+	}
+	avroConsumer.Close()
+}
+
+func TestAvroConsumer_DrainContext(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	callbacks := ConsumerCallbacks{OnDataReceived: func(msg Message) {
+		close(started)
+		<-release
+	}}
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, nil, callbacks, NewDefaultConfig())
+	consumed := make(chan error)
+	go func() { consumed <- avroConsumer.Consume() }()
+	mockConsumer.messages <- &sarama.ConsumerMessage{Topic: "test"}
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := avroConsumer.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the context error, got %v", err)
+	}
+	close(release)
+	<-consumed
+	avroConsumer.Close()
+}
+
+func TestAvroConsumer_AllowedSubjects(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.AllowedSubjects = []string{"other"}
+	consumerMsg := &sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec), Topic: "test"}
+	_, err := avroConsumer.ProcessAvroMsg(consumerMsg)
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrSubjectNotAllowed || decodeErr.SchemaId != 1 {
+		t.Errorf("Expected ErrSubjectNotAllowed, got %v", err)
+	}
+	if ids := schemaRegistryMock.CachedIDs(); len(ids) != 0 {
+		t.Errorf("Expected the schema not to be fetched, got %v", ids)
+	}
+	avroConsumer.AllowedSubjects = append(avroConsumer.AllowedSubjects, "test")
+	if _, err := avroConsumer.ProcessAvroMsg(consumerMsg); err != nil {
+		t.Errorf("Error process avro msg: %v", err)
+	}
+	if schemaRegistryTestObject.Count != 2 {
+		t.Errorf("Expected the subjects to be fetched once and the schema once, got %d requests", schemaRegistryTestObject.Count)
+	}
+}
+
+func TestAvroConsumer_NullableUnions(t *testing.T) {
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "test", "fields": [
+		{"name": "name", "type": ["null", "string"]},
+		{"name": "nick", "type": ["null", "string"]},
+		{"name": "tags", "type": {"type": "array", "items": ["null", "long"]}},
+		{"name": "id", "type": ["string", "long"]}]}`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{"http://localhost"})
+	schemaRegistryMock.schemaCache[2] = codec
+	binaryValue, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"name": goavro.Union("string", "x"),
+		"nick": nil,
+		"tags": []interface{}{goavro.Union("long", 1), nil},
+		"id":   goavro.Union("long", 7),
+	})
+	if err != nil {
+		t.Fatalf("Error get binary from native: %v", err)
+	}
+	tests := []struct {
+		mode     NullableUnions
+		expected string
+	}{
+		{NullableUnionsFlattened, `{"id":{"long":7},"name":"x","nick":null,"tags":[1,null]}`},
+		{NullableUnionsOmitted, `{"id":{"long":7},"name":"x","tags":[1,null]}`},
+	}
+	for _, test := range tests {
+		avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+		avroConsumer.NullableUnions = test.mode
+		msg, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: encodeAvroMsg(2, binaryValue)})
+		if err != nil {
+			t.Errorf("Error process avro msg: %v", err)
+		}
+		if msg.Value != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, msg.Value)
+		}
+		for _, lazy := range []bool{false, true} {
+			avroConsumer.LazyDecode = lazy
+			msg, _ := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: encodeAvroMsg(2, binaryValue)})
+			if reEncoded, err := msg.ReEncode(codec); err != nil || !bytes.Equal(reEncoded, encodeAvroMsg(2, binaryValue)) {
+				t.Errorf("Expected the simplified value to re-encode to the original, got %v: %v", reEncoded, err)
+			}
+			msg.DecodedValue()
+			msg.Value = strings.Replace(msg.Value, `"x"`, `"y"`, 1)
+			if _, err := msg.ReEncode(codec); err != ErrSimplifiedValueChanged {
+				t.Errorf("Expected ErrSimplifiedValueChanged for an edited simplified value, got %v", err)
+			}
+		}
+	}
+}
+
+type resettableConsumer struct {
+	*mockClusterConsumer
+	resets []*sarama.ConsumerMessage
+}
+
+func (c *resettableConsumer) Subscriptions() map[string][]int32 {
+	return map[string][]int32{"test": {0, 1}}
+}
+
+func (c *resettableConsumer) ResetPartitionOffset(topic string, partition int32, offset int64, metadata string) {
+	c.resets = append(c.resets, &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: offset})
+}
+
+type offsetClientFunc func(topic string, partition int32, time int64) (int64, error)
+
+func (f offsetClientFunc) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	return f(topic, partition, time)
+}
+
+func TestAvroConsumer_ResetOffsets(t *testing.T) {
+	mockConsumer := &resettableConsumer{mockClusterConsumer: newMockClusterConsumer()}
+	avroConsumer := newAvroConsumer(mockConsumer, nil, ConsumerCallbacks{}, nil)
+	if err := avroConsumer.ResetToEarliest(); err != ErrOffsetResetUnsupported {
+		t.Errorf("Expected ErrOffsetResetUnsupported without a client, got %v", err)
+	}
+	avroConsumer.offsets = offsetClientFunc(func(topic string, partition int32, time int64) (int64, error) {
+		if time == sarama.OffsetOldest {
+			return 10 * int64(partition), nil
+		}
+		return 100 + int64(partition), nil
+	})
+	if err := avroConsumer.ResetToEarliest(); err != nil {
+		t.Fatalf("Error resetting to earliest: %v", err)
+	}
+	if err := avroConsumer.ResetToLatest(); err != nil {
+		t.Fatalf("Error resetting to latest: %v", err)
+	}
+	offsets := func(messages []*sarama.ConsumerMessage) map[int32]int64 {
+		result := map[int32]int64{}
+		for _, m := range messages {
+			result[m.Partition] = m.Offset
+		}
+		return result
+	}
+	if resets := offsets(mockConsumer.resets); !reflect.DeepEqual(resets, map[int32]int64{0: -1, 1: 9}) {
+		t.Errorf("Expected the offsets before the oldest messages to be reset, got %v", resets)
+	}
+	if marked := offsets(mockConsumer.marked); !reflect.DeepEqual(marked, map[int32]int64{0: 99, 1: 100}) {
+		t.Errorf("Expected the offsets before the newest messages to be marked, got %v", marked)
+	}
+	if mockConsumer.commits != 2 {
+		t.Errorf("Expected both resets to be committed, got %d commits", mockConsumer.commits)
+	}
+}
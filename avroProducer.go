@@ -4,30 +4,77 @@ import (
 	"encoding/binary"
 	"github.com/Shopify/sarama"
 	"github.com/linkedin/goavro"
+	"time"
 )
 
 type AvroProducer struct {
+	// SchemaRegistryClient registers and looks up the schemas of produced records, e.g. start its
+	// StartSubjectRefresher with UseLatestSchema
+	SchemaRegistryClient *CachedSchemaRegistryClient
 	producer             sarama.SyncProducer
-	schemaRegistryClient *CachedSchemaRegistryClient
+
+	// SubjectNameStrategy returns the subject schemas are registered under, e.g. RecordNameStrategy
+	// for topics carrying several record types. Schemas are registered under the topic name when nil
+	SubjectNameStrategy SubjectNameStrategy
+	// BeforeProduce is called with the native goavro value of every record before it is encoded, e.g. to default
+	// fields, redact or sample. It returns the value to send, or false to drop the record, see Produce
+	BeforeProduce func(topic string, value interface{}) (interface{}, bool)
+	// UseLatestSchema frames records with the id of the latest version of their subject from GetLatestSchemaId
+	// instead of registering the schema, e.g. when producers aren't allowed to register schemas. The schema passed
+	// to Produce has to match that version. The id is cached, StartSubjectRefresher picks up new versions
+	UseLatestSchema bool
+}
+
+// SubjectNameStrategy returns the subject a schema is registered under when it is produced to a topic
+type SubjectNameStrategy func(topic string, codec *goavro.Codec) (string, error)
+
+// RecordNameStrategy registers schemas under the full name of their record, e.g. "com.example.Created"
+func RecordNameStrategy(topic string, codec *goavro.Codec) (string, error) {
+	// the codec is usually built per call, parse it once here rather than caching it for the life of the process
+	schema, err := parseAvroSchema(codec.Schema())
+	if err != nil {
+		return "", err
+	}
+	if schema.Name == "" {
+		return "", ErrUnnamedSchema
+	}
+	return schema.Name, nil
+}
+
+// TopicRecordNameStrategy registers schemas under the topic and the full name of their record,
+// e.g. "orders-com.example.Created"
+func TopicRecordNameStrategy(topic string, codec *goavro.Codec) (string, error) {
+	name, err := RecordNameStrategy(topic, codec)
+	if err != nil {
+		return "", err
+	}
+	return topic + "-" + name, nil
 }
 
 // NewAvroProducer is a basic producer to interact with schema registry, avro and kafka
 func NewAvroProducer(kafkaServers []string, schemaRegistryServers []string) (*AvroProducer, error) {
-	config := sarama.NewConfig()
-	config.Producer.Partitioner = sarama.NewRandomPartitioner
-	config.Producer.Return.Successes = true
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	producer, err := sarama.NewSyncProducer(kafkaServers, config)
+	producer, err := sarama.NewSyncProducer(kafkaServers, newProducerConfig())
 	if err != nil {
 		return nil, err
 	}
 	schemaRegistryClient := NewCachedSchemaRegistryClient(schemaRegistryServers)
-	return &AvroProducer{producer, schemaRegistryClient}, nil
+	return &AvroProducer{producer: producer, SchemaRegistryClient: schemaRegistryClient}, nil
+}
+
+// newProducerConfig waits for all in-sync replicas so a sent message is never lost,
+// message timestamps require kafka 0.10+
+func newProducerConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_0_0
+	config.Producer.Partitioner = sarama.NewRandomPartitioner
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	return config
 }
 
 //GetSchemaId get schema id from schema-registry service
 func (ap *AvroProducer) GetSchemaId(topic string, avroCodec *goavro.Codec) (int, error) {
-	schemaId, err := ap.schemaRegistryClient.CreateSubject(topic, avroCodec)
+	schemaId, err := ap.SchemaRegistryClient.CreateSubject(topic, avroCodec)
 	if err != nil {
 		return 0, err
 	}
@@ -35,24 +82,74 @@ func (ap *AvroProducer) GetSchemaId(topic string, avroCodec *goavro.Codec) (int,
 }
 
 func (ap *AvroProducer) Add(topic string, schema string, key []byte, value []byte) error {
+	return ap.AddWithTimestamp(topic, schema, key, value, time.Time{})
+}
+
+// AddWithTimestamp is like Add with the event time of the message, e.g. to backfill historical data.
+// The broker sets the timestamp when it is zero
+func (ap *AvroProducer) AddWithTimestamp(topic string, schema string, key []byte, value []byte, timestamp time.Time) error {
+	_, err := ap.Produce(topic, schema, key, value, timestamp)
+	return err
+}
+
+// Produce is like AddWithTimestamp and reports whether the record was sent,
+// records dropped by BeforeProduce are not sent and don't return an error
+func (ap *AvroProducer) Produce(topic string, schema string, key []byte, value []byte, timestamp time.Time) (bool, error) {
 	avroCodec, err := goavro.NewCodec(schema)
-	schemaId, err := ap.GetSchemaId(topic, avroCodec)
 	if err != nil {
-		return err
+		return false, err
 	}
-	binarySchemaId := make([]byte, 4)
-	binary.BigEndian.PutUint32(binarySchemaId, uint32(schemaId))
-
 	native, _, err := avroCodec.NativeFromTextual(value)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if ap.BeforeProduce != nil {
+		var keep bool
+		if native, keep = ap.BeforeProduce(topic, native); !keep {
+			return false, nil
+		}
+	}
+
+	subject := topic
+	if ap.SubjectNameStrategy != nil {
+		if subject, err = ap.SubjectNameStrategy(topic, avroCodec); err != nil {
+			return false, err
+		}
+	}
+	var schemaId int
+	if ap.UseLatestSchema {
+		schemaId, err = ap.SchemaRegistryClient.GetLatestSchemaId(subject)
+	} else {
+		schemaId, err = ap.GetSchemaId(subject, avroCodec)
+	}
+	if err != nil {
+		return false, err
 	}
 
 	// Convert native Go form to binary Avro data
 	binaryValue, err := avroCodec.BinaryFromNative(nil, native)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	binaryMsg := encodeAvroMsg(schemaId, binaryValue)
+
+	msg := &sarama.ProducerMessage{
+		Topic:     topic,
+		Key:       sarama.StringEncoder(key),
+		Value:     sarama.StringEncoder(binaryMsg),
+		Timestamp: timestamp,
 	}
+	if _, _, err = ap.producer.SendMessage(msg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// encodeAvroMsg prepends the schema registry framing to avro binary data
+func encodeAvroMsg(schemaId int, binaryValue []byte) []byte {
+	binarySchemaId := make([]byte, 4)
+	binary.BigEndian.PutUint32(binarySchemaId, uint32(schemaId))
 
 	var binaryMsg []byte
 	// first byte is magic byte, always 0 for now
@@ -61,14 +158,7 @@ func (ap *AvroProducer) Add(topic string, schema string, key []byte, value []byt
 	binaryMsg = append(binaryMsg, binarySchemaId...)
 	//avro serialized data in Avro’s binary encoding
 	binaryMsg = append(binaryMsg, binaryValue...)
-
-	msg := &sarama.ProducerMessage{
-		Topic: topic,
-		Key:   sarama.StringEncoder(key),
-		Value: sarama.StringEncoder(binaryMsg),
-	}
-	_, _, err = ap.producer.SendMessage(msg)
-	return err
+	return binaryMsg
 }
 
 func (ac *AvroProducer) Close() {
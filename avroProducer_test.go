@@ -1,8 +1,15 @@
 package kafka
 
 import (
-	"github.com/Shopify/sarama/mocks"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/Shopify/sarama/mocks"
+	"github.com/linkedin/goavro"
 )
 
 func TestAvroProducer_Add(t *testing.T) {
@@ -10,10 +17,131 @@ func TestAvroProducer_Add(t *testing.T) {
 	producerMock.ExpectSendMessageAndSucceed()
 	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
 	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
-	avroProducer := &AvroProducer{producerMock, schemaRegistryMock}
+	avroProducer := &AvroProducer{producer: producerMock, SchemaRegistryClient: schemaRegistryMock}
 	defer avroProducer.Close()
 	err := avroProducer.Add("test", schemaRegistryTestObject.Codec.Schema(), []byte("key"), []byte(`{"val":1}`))
 	if nil != err {
 		t.Errorf("Error adding msg: %v", err)
 	}
 }
+
+func TestAvroProducer_AddWithTimestamp(t *testing.T) {
+	producer := &capturingProducer{}
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroProducer := &AvroProducer{producer: producer, SchemaRegistryClient: schemaRegistryMock}
+	timestamp := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	err := avroProducer.AddWithTimestamp("test", schemaRegistryTestObject.Codec.Schema(), []byte("key"), []byte(`{"val":1}`), timestamp)
+	if nil != err {
+		t.Errorf("Error adding msg: %v", err)
+	}
+	if len(producer.sent) != 1 || !producer.sent[0].Timestamp.Equal(timestamp) {
+		t.Errorf("Expected the message to be sent with timestamp %s", timestamp)
+	}
+}
+
+func TestAvroProducer_RecordNameStrategy(t *testing.T) {
+	producer := &capturingProducer{}
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test.ns.test", 3)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroProducer := &AvroProducer{producer: producer, SchemaRegistryClient: schemaRegistryMock, SubjectNameStrategy: RecordNameStrategy}
+	err := avroProducer.Add("orders", schemaRegistryTestObject.Codec.Schema(), []byte("key"), []byte(`{"val":1}`))
+	if nil != err {
+		t.Fatalf("Error adding msg: %v", err)
+	}
+	value, _ := producer.sent[0].Value.Encode()
+	if id, err := ParseSchemaID(value); err != nil || id != 3 {
+		t.Errorf("Expected the schema registered under the record name, got id %d, %v", id, err)
+	}
+}
+
+func TestSubjectNameStrategies(t *testing.T) {
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "Created", "namespace": "com.example", "fields": [{"name": "id", "type": "long"}]}`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	if subject, err := RecordNameStrategy("orders", codec); err != nil || subject != "com.example.Created" {
+		t.Errorf("Expected com.example.Created, got %s, %v", subject, err)
+	}
+	if subject, err := TopicRecordNameStrategy("orders", codec); err != nil || subject != "orders-com.example.Created" {
+		t.Errorf("Expected orders-com.example.Created, got %s, %v", subject, err)
+	}
+	unnamed, err := goavro.NewCodec(`["null", "string"]`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	if _, err := RecordNameStrategy("orders", unnamed); err != ErrUnnamedSchema {
+		t.Errorf("Expected ErrUnnamedSchema, got %v", err)
+	}
+}
+
+func TestAvroProducer_BeforeProduce(t *testing.T) {
+	producer := &capturingProducer{}
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroProducer := &AvroProducer{producer: producer, SchemaRegistryClient: schemaRegistryMock}
+	avroProducer.BeforeProduce = func(topic string, value interface{}) (interface{}, bool) {
+		record := value.(map[string]interface{})
+		if record["val"] == int32(0) {
+			return nil, false
+		}
+		record["val"] = int32(42)
+		return record, true
+	}
+	sent, err := avroProducer.Produce("test", schemaRegistryTestObject.Codec.Schema(), []byte("key"), []byte(`{"val":0}`), time.Time{})
+	if sent || err != nil || len(producer.sent) != 0 {
+		t.Errorf("Expected the record to be dropped without an error, got %t, %v", sent, err)
+	}
+	sent, err = avroProducer.Produce("test", schemaRegistryTestObject.Codec.Schema(), []byte("key"), []byte(`{"val":1}`), time.Time{})
+	if !sent || err != nil || len(producer.sent) != 1 {
+		t.Fatalf("Expected the record to be sent, got %t, %v", sent, err)
+	}
+	value, _ := producer.sent[0].Value.Encode()
+	native, _, err := schemaRegistryTestObject.Codec.NativeFromBinary(value[5:])
+	if err != nil || native.(map[string]interface{})["val"] != int32(42) {
+		t.Errorf("Expected the rewritten value to be sent, got %v, %v", native, err)
+	}
+}
+
+func TestAvroProducer_UseLatestSchema(t *testing.T) {
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "test", "fields": [{"name": "val", "type": "int"}]}`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	latestId := int32(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/subjects/orders/versions/latest" {
+			t.Errorf("Expected only the latest version to be fetched, got %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(schemaVersionResponse{Subject: "orders", Version: 1, Schema: codec.Schema(),
+			ID: int(atomic.LoadInt32(&latestId))})
+	}))
+	defer server.Close()
+	producer := &capturingProducer{}
+	avroProducer := &AvroProducer{producer: producer, SchemaRegistryClient: NewCachedSchemaRegistryClient([]string{server.URL}),
+		UseLatestSchema: true}
+	sentId := func() int {
+		if err := avroProducer.Add("orders", codec.Schema(), []byte("key"), []byte(`{"val":1}`)); err != nil {
+			t.Fatalf("Error adding msg: %v", err)
+		}
+		value, _ := producer.sent[len(producer.sent)-1].Value.Encode()
+		id, _ := ParseSchemaID(value)
+		return id
+	}
+	if id := sentId(); id != 1 {
+		t.Errorf("Expected the latest schema id 1, got %d", id)
+	}
+	atomic.StoreInt32(&latestId, 2)
+	if id := sentId(); id != 1 {
+		t.Errorf("Expected the cached schema id 1, got %d", id)
+	}
+	if err := avroProducer.SchemaRegistryClient.StartSubjectRefresher([]string{"orders"}, time.Hour); err != nil {
+		t.Fatalf("Error starting refresher: %v", err)
+	}
+	defer avroProducer.SchemaRegistryClient.StopSubjectRefresher()
+	if id := sentId(); id != 2 {
+		t.Errorf("Expected the refreshed schema id 2, got %d", id)
+	}
+}
@@ -0,0 +1,526 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/linkedin/goavro"
+)
+
+// avroSchema is a parsed avro schema with all named type references resolved,
+// it complements goavro.Codec for features that need to know the shape of the data
+type avroSchema struct {
+	Type     string
+	Name     string
+	Fields   []avroField
+	Symbols  []string
+	Items    *avroSchema
+	Values   *avroSchema
+	Branches []*avroSchema
+	Size     int
+}
+
+type avroField struct {
+	Name string
+	Type *avroSchema
+}
+
+var errTruncated = errors.New("buffer is truncated")
+
+// EnumSymbols returns the symbols of an enum field of the codec's record schema, nested fields are separated by dots,
+// e.g. "order.status". Unions are searched for an enum or record branch
+func EnumSymbols(codec *goavro.Codec, field string) ([]string, error) {
+	schema, err := parseAvroSchema(codec.Schema())
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(field, ".") {
+		record := schema.branch("record")
+		if record == nil {
+			return nil, fmt.Errorf("%q is not a record", name)
+		}
+		schema = nil
+		for _, f := range record.Fields {
+			if f.Name == name {
+				schema = f.Type
+			}
+		}
+		if schema == nil {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+	}
+	enum := schema.branch("enum")
+	if enum == nil {
+		return nil, fmt.Errorf("field %q is not an enum", field)
+	}
+	return enum.Symbols, nil
+}
+
+// parseAvroSchema parses the json schema of a codec
+func parseAvroSchema(schema string) (*avroSchema, error) {
+	var spec interface{}
+	if err := json.Unmarshal([]byte(schema), &spec); err != nil {
+		// unadorned primitive type names are valid schemas as well
+		spec = schema
+	}
+	return parseAvroType(spec, "", make(map[string]*avroSchema))
+}
+
+func parseAvroType(spec interface{}, namespace string, names map[string]*avroSchema) (*avroSchema, error) {
+	switch v := spec.(type) {
+	case string:
+		return resolveAvroType(v, namespace, names)
+	case []interface{}:
+		union := &avroSchema{Type: "union"}
+		for _, branch := range v {
+			branchSchema, err := parseAvroType(branch, namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			union.Branches = append(union.Branches, branchSchema)
+		}
+		return union, nil
+	case map[string]interface{}:
+		return parseAvroComplexType(v, namespace, names)
+	}
+	return nil, fmt.Errorf("unsupported schema definition %v", spec)
+}
+
+func resolveAvroType(typeName string, namespace string, names map[string]*avroSchema) (*avroSchema, error) {
+	switch typeName {
+	case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+		return &avroSchema{Type: typeName}, nil
+	}
+	if schema, ok := names[fullName(typeName, namespace)]; ok {
+		return schema, nil
+	}
+	if schema, ok := names[typeName]; ok {
+		return schema, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", typeName)
+}
+
+func parseAvroComplexType(spec map[string]interface{}, namespace string, names map[string]*avroSchema) (*avroSchema, error) {
+	typeName, ok := spec["type"].(string)
+	if !ok {
+		// the type is itself a schema, e.g. {"type": {"type": "array", "items": "int"}}
+		return parseAvroType(spec["type"], namespace, names)
+	}
+	schema := &avroSchema{Type: typeName}
+	switch typeName {
+	case "record", "error", "enum", "fixed":
+		name, _ := spec["name"].(string)
+		if ns, ok := spec["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		schema.Name = fullName(name, namespace)
+		if i := strings.LastIndex(schema.Name, "."); i >= 0 {
+			namespace = schema.Name[:i]
+		}
+		// register before descending so recursive types can reference themselves
+		names[schema.Name] = schema
+	}
+	switch typeName {
+	case "record", "error":
+		schema.Type = "record"
+		fields, _ := spec["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			fieldName, _ := field["name"].(string)
+			fieldType, err := parseAvroType(field["type"], namespace, names)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %s", fieldName, err)
+			}
+			schema.Fields = append(schema.Fields, avroField{fieldName, fieldType})
+		}
+	case "enum":
+		symbols, _ := spec["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			s, _ := symbol.(string)
+			schema.Symbols = append(schema.Symbols, s)
+		}
+	case "fixed":
+		size, _ := spec["size"].(float64)
+		schema.Size = int(size)
+	case "array":
+		items, err := parseAvroType(spec["items"], namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		schema.Items = items
+	case "map":
+		values, err := parseAvroType(spec["values"], namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		schema.Values = values
+	default:
+		// primitive type with attributes, e.g. a logical type
+		return resolveAvroType(typeName, namespace, names)
+	}
+	return schema, nil
+}
+
+// typeName is the name goavro uses for the type in unions, the full name of named types
+func (schema *avroSchema) typeName() string {
+	if schema.Name != "" {
+		return schema.Name
+	}
+	return schema.Type
+}
+
+// branch returns the schema itself or the first branch of a union with the given type
+func (schema *avroSchema) branch(typeName string) *avroSchema {
+	if schema.Type == typeName {
+		return schema
+	}
+	for _, branch := range schema.Branches {
+		if branch.Type == typeName {
+			return branch
+		}
+	}
+	return nil
+}
+
+// unwrapEnums replaces union values of enum branches in decoded textual data, {"test.Status": "ACTIVE"},
+// by the plain symbol
+func (schema *avroSchema) unwrapEnums(value interface{}) interface{} {
+	switch schema.Type {
+	case "record":
+		if record, ok := value.(map[string]interface{}); ok {
+			for _, field := range schema.Fields {
+				if fieldValue, ok := record[field.Name]; ok {
+					record[field.Name] = field.Type.unwrapEnums(fieldValue)
+				}
+			}
+		}
+	case "array":
+		if items, ok := value.([]interface{}); ok {
+			for i, item := range items {
+				items[i] = schema.Items.unwrapEnums(item)
+			}
+		}
+	case "map":
+		if values, ok := value.(map[string]interface{}); ok {
+			for key, v := range values {
+				values[key] = schema.Values.unwrapEnums(v)
+			}
+		}
+	case "union":
+		wrapped, ok := value.(map[string]interface{})
+		if !ok || len(wrapped) != 1 {
+			return value
+		}
+		for name, v := range wrapped {
+			for _, branch := range schema.Branches {
+				if branch.typeName() != name {
+					continue
+				}
+				if branch.Type == "enum" {
+					return v
+				}
+				wrapped[name] = branch.unwrapEnums(v)
+			}
+		}
+	}
+	return value
+}
+
+// NullableUnions is how values of unions of null and a single other type are written
+type NullableUnions int
+
+const (
+	// NullableUnionsWrapped writes them like goavro, null or {"string": "x"}
+	NullableUnionsWrapped NullableUnions = iota
+	// NullableUnionsFlattened writes the plain value, null or "x"
+	NullableUnionsFlattened
+	// NullableUnionsOmitted writes the plain value and leaves out record fields that are null
+	NullableUnionsOmitted
+)
+
+// nullable reports whether the schema is a union of null and a single other type
+func (schema *avroSchema) nullable() bool {
+	return schema.Type == "union" && len(schema.Branches) == 2 && schema.branch("null") != nil
+}
+
+// flattenNullable replaces union values of nullable unions in decoded textual data, {"string": "x"}, by the plain
+// value, record fields that are null are removed when omitNull is set
+func (schema *avroSchema) flattenNullable(value interface{}, omitNull bool) interface{} {
+	switch schema.Type {
+	case "record":
+		if record, ok := value.(map[string]interface{}); ok {
+			for _, field := range schema.Fields {
+				fieldValue, ok := record[field.Name]
+				if !ok {
+					continue
+				}
+				if fieldValue = field.Type.flattenNullable(fieldValue, omitNull); fieldValue == nil && omitNull {
+					delete(record, field.Name)
+				} else {
+					record[field.Name] = fieldValue
+				}
+			}
+		}
+	case "array":
+		if items, ok := value.([]interface{}); ok {
+			for i, item := range items {
+				items[i] = schema.Items.flattenNullable(item, omitNull)
+			}
+		}
+	case "map":
+		if values, ok := value.(map[string]interface{}); ok {
+			for key, v := range values {
+				values[key] = schema.Values.flattenNullable(v, omitNull)
+			}
+		}
+	case "union":
+		wrapped, ok := value.(map[string]interface{})
+		if !ok || len(wrapped) != 1 {
+			return value
+		}
+		for name, v := range wrapped {
+			for _, branch := range schema.Branches {
+				if branch.typeName() != name {
+					continue
+				}
+				if v = branch.flattenNullable(v, omitNull); schema.nullable() {
+					return v
+				}
+				wrapped[name] = v
+			}
+		}
+	}
+	return value
+}
+
+// transformStrings applies transform to the strings of a native goavro value, keys of maps are left as they are
+func (schema *avroSchema) transformStrings(value interface{}, transform func(string) string) interface{} {
+	switch schema.Type {
+	case "string":
+		if s, ok := value.(string); ok {
+			return transform(s)
+		}
+	case "record":
+		if record, ok := value.(map[string]interface{}); ok {
+			for _, field := range schema.Fields {
+				if fieldValue, ok := record[field.Name]; ok {
+					record[field.Name] = field.Type.transformStrings(fieldValue, transform)
+				}
+			}
+		}
+	case "array":
+		if items, ok := value.([]interface{}); ok {
+			for i, item := range items {
+				items[i] = schema.Items.transformStrings(item, transform)
+			}
+		}
+	case "map":
+		if values, ok := value.(map[string]interface{}); ok {
+			for key, v := range values {
+				values[key] = schema.Values.transformStrings(v, transform)
+			}
+		}
+	case "union":
+		if wrapped, ok := value.(map[string]interface{}); ok {
+			for name, v := range wrapped {
+				for _, branch := range schema.Branches {
+					if branch.typeName() == name {
+						wrapped[name] = branch.transformStrings(v, transform)
+					}
+				}
+			}
+		}
+	}
+	return value
+}
+
+// Latin1ToUTF8 re-interprets a string of Latin-1 (ISO 8859-1) bytes as UTF-8, for StringTransform
+func Latin1ToUTF8(s string) string {
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
+
+func fullName(name string, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// skipBinary walks over one binary encoded datum without decoding it, when the data is malformed
+// it returns the path of the field where the walk failed
+func (schema *avroSchema) skipBinary(buf []byte, path string) ([]byte, string, error) {
+	return schema.skipNested(buf, path, -1)
+}
+
+// checkDepth walks over one binary encoded datum and fails with ErrMaxDepthExceeded when records, arrays and maps
+// are nested deeper than maxDepth
+func (schema *avroSchema) checkDepth(buf []byte, maxDepth int) (string, error) {
+	_, path, err := schema.skipNested(buf, "", maxDepth)
+	return path, err
+}
+
+// skipNested is skipBinary with the number of records, arrays and maps the walk may still descend into,
+// there is no limit when depth is negative
+func (schema *avroSchema) skipNested(buf []byte, path string, depth int) ([]byte, string, error) {
+	var err error
+	switch schema.Type {
+	case "record", "array", "map":
+		if depth == 0 {
+			return buf, path, ErrMaxDepthExceeded
+		}
+		depth--
+	}
+	switch schema.Type {
+	case "null":
+		return buf, path, nil
+	case "boolean":
+		return skipBytes(buf, 1, path)
+	case "int", "long":
+		_, buf, err = readVarint(buf)
+		return buf, path, err
+	case "float":
+		return skipBytes(buf, 4, path)
+	case "double":
+		return skipBytes(buf, 8, path)
+	case "fixed":
+		return skipBytes(buf, schema.Size, path)
+	case "bytes", "string":
+		var size int64
+		if size, buf, err = readVarint(buf); err != nil {
+			return buf, path, err
+		}
+		if size < 0 {
+			return buf, path, fmt.Errorf("negative length %d", size)
+		}
+		return skipBytes(buf, int(size), path)
+	case "enum":
+		var index int64
+		if index, buf, err = readVarint(buf); err != nil {
+			return buf, path, err
+		}
+		if index < 0 || index >= int64(len(schema.Symbols)) {
+			return buf, path, fmt.Errorf("enum index %d out of range", index)
+		}
+		return buf, path, nil
+	case "union":
+		var index int64
+		if index, buf, err = readVarint(buf); err != nil {
+			return buf, path, err
+		}
+		if index < 0 || index >= int64(len(schema.Branches)) {
+			return buf, path, fmt.Errorf("union index %d out of range", index)
+		}
+		return schema.Branches[index].skipNested(buf, path, depth)
+	case "record":
+		for _, field := range schema.Fields {
+			fieldPath := field.Name
+			if path != "" {
+				fieldPath = path + "." + field.Name
+			}
+			if buf, fieldPath, err = field.Type.skipNested(buf, fieldPath, depth); err != nil {
+				return buf, fieldPath, err
+			}
+		}
+		return buf, path, nil
+	case "array", "map":
+		return schema.skipBlocks(buf, path, depth)
+	}
+	return buf, path, fmt.Errorf("unsupported type %q", schema.Type)
+}
+
+func (schema *avroSchema) skipBlocks(buf []byte, path string, depth int) ([]byte, string, error) {
+	// map entries start with the length of their key, only arrays of e.g. nulls hold items encoded with no bytes
+	zeroWidth := schema.Type == "array" && schema.Items.zeroWidth()
+	var err error
+	for i := 0; ; {
+		var count int64
+		if count, buf, err = readVarint(buf); err != nil {
+			return buf, path, err
+		}
+		if count == 0 {
+			return buf, path, nil
+		}
+		if count < 0 {
+			// a negative count is followed by the block size in bytes
+			count = -count
+			if _, buf, err = readVarint(buf); err != nil {
+				return buf, path, err
+			}
+		}
+		if zeroWidth {
+			// every item is the same, walking one of them is enough
+			count = 1
+		} else if count > int64(len(buf)) {
+			return buf, path, errTruncated
+		}
+		for ; count > 0; count-- {
+			// paths of items are only built for the item that fails
+			var nested string
+			if schema.Type == "map" {
+				var key int64
+				if key, buf, err = readVarint(buf); err != nil || key < 0 || key > int64(len(buf)) {
+					return buf, fmt.Sprintf("%s[%d]", path, i), errTruncated
+				}
+				name := buf[:key]
+				if buf, nested, err = schema.Values.skipNested(buf[key:], "", depth); err != nil {
+					return buf, joinPath(fmt.Sprintf("%s[%s]", path, name), nested), err
+				}
+			} else if buf, nested, err = schema.Items.skipNested(buf, "", depth); err != nil {
+				return buf, joinPath(fmt.Sprintf("%s[%d]", path, i), nested), err
+			}
+			i++
+		}
+	}
+}
+
+// zeroWidth reports whether values of the schema are encoded with no bytes at all, e.g. null or a record of nulls
+func (schema *avroSchema) zeroWidth() bool {
+	switch schema.Type {
+	case "null":
+		return true
+	case "fixed":
+		return schema.Size == 0
+	case "record":
+		for _, field := range schema.Fields {
+			if !field.Type.zeroWidth() {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// joinPath appends the path of the field that failed within an array item or map value to the path of the item
+func joinPath(path string, nested string) string {
+	if nested == "" || strings.HasPrefix(nested, "[") {
+		return path + nested
+	}
+	return path + "." + nested
+}
+
+func skipBytes(buf []byte, n int, path string) ([]byte, string, error) {
+	if len(buf) < n {
+		return buf, path, errTruncated
+	}
+	return buf[n:], path, nil
+}
+
+// readVarint reads a zig-zag encoded variable length integer
+func readVarint(buf []byte) (int64, []byte, error) {
+	var value uint64
+	for i := 0; i < len(buf) && i < 10; i++ {
+		b := buf[i]
+		value |= uint64(b&0x7f) << (7 * uint(i))
+		if b&0x80 == 0 {
+			return int64(value>>1) ^ -int64(value&1), buf[i+1:], nil
+		}
+	}
+	return 0, buf, errTruncated
+}
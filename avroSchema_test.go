@@ -0,0 +1,91 @@
+package kafka
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/linkedin/goavro"
+)
+
+var nestedTestSchema = `{"type": "record", "name": "order", "namespace": "test", "fields": [
+	{"name": "id", "type": "long"},
+	{"name": "status", "type": {"type": "enum", "name": "status", "symbols": ["NEW", "DONE"]}},
+	{"name": "items", "type": {"type": "array", "items": {"type": "record", "name": "item", "fields": [
+		{"name": "name", "type": "string"},
+		{"name": "price", "type": ["null", "double"]}
+	]}}},
+	{"name": "previous", "type": ["null", "order"]}
+]}`
+
+func TestParseAvroSchema(t *testing.T) {
+	schema, err := parseAvroSchema(nestedTestSchema)
+	if err != nil {
+		t.Errorf("Error parsing schema: %v", err)
+	}
+	if schema.Name != "test.order" || len(schema.Fields) != 4 {
+		t.Errorf("Unexpected record %s with %d fields", schema.Name, len(schema.Fields))
+	}
+	if schema.Fields[1].Type.Type != "enum" || len(schema.Fields[1].Type.Symbols) != 2 {
+		t.Errorf("Expected enum with 2 symbols, got %v", schema.Fields[1].Type)
+	}
+	if schema.Fields[3].Type.Branches[1] != schema {
+		t.Errorf("Expected recursive reference to resolve to the record itself")
+	}
+}
+
+func TestAvroSchema_SkipBinary(t *testing.T) {
+	schema, err := parseAvroSchema(nestedTestSchema)
+	if err != nil {
+		t.Errorf("Error parsing schema: %v", err)
+	}
+	// id 1, status DONE, one item "ab" with price 1.0, no previous order
+	valid := []byte{2, 2, 2, 4, 'a', 'b', 2, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0, 0}
+	remaining, _, err := schema.skipBinary(valid, "")
+	if err != nil || len(remaining) != 0 {
+		t.Errorf("Expected valid data to be consumed, got %v with %d remaining bytes", err, len(remaining))
+	}
+	_, path, err := schema.skipBinary(valid[:10], "")
+	if err == nil || path != "items[0].price" {
+		t.Errorf("Expected failure at items[0].price, got %q: %v", path, err)
+	}
+	invalidEnum := []byte{2, 6}
+	_, path, err = schema.skipBinary(invalidEnum, "")
+	if err == nil || path != "status" {
+		t.Errorf("Expected failure at status, got %q: %v", path, err)
+	}
+}
+
+func TestAvroSchema_SkipBinaryBlockCount(t *testing.T) {
+	longs, _ := parseAvroSchema(`{"type": "array", "items": "long"}`)
+	// a block of 2^62 items in a 10 byte value
+	huge := []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 2}
+	if _, _, err := longs.skipBinary(huge, ""); err != errTruncated {
+		t.Errorf("Expected errTruncated for a count larger than the value, got %v", err)
+	}
+	nulls, _ := parseAvroSchema(`{"type": "array", "items": "null"}`)
+	remaining, _, err := nulls.skipBinary(append(huge[:9:9], 0), "")
+	if err != nil || len(remaining) != 0 {
+		t.Errorf("Expected items encoded with no bytes to be skipped at once, got %v with %d remaining bytes", err, len(remaining))
+	}
+	records, _ := parseAvroSchema(`{"type": "map", "values": {"type": "record", "name": "r", "fields": [{"name": "a", "type": "int"}]}}`)
+	if _, path, err := records.skipBinary([]byte{2, 2, 'k'}, "values"); err == nil || path != "values[k].a" {
+		t.Errorf("Expected failure at values[k].a, got %q: %v", path, err)
+	}
+}
+
+func TestEnumSymbols(t *testing.T) {
+	codec, err := goavro.NewCodec(nestedTestSchema)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	symbols, err := EnumSymbols(codec, "previous.status")
+	if err != nil {
+		t.Errorf("Error listing enum symbols: %v", err)
+	}
+	if !reflect.DeepEqual(symbols, []string{"NEW", "DONE"}) {
+		t.Errorf("Expected symbols NEW and DONE, got %v", symbols)
+	}
+	if _, err := EnumSymbols(codec, "id"); err == nil {
+		t.Errorf("Expected an error for a field that isn't an enum")
+	}
+}
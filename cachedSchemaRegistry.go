@@ -1,8 +1,12 @@
 package kafka
 
 import (
+	"encoding/json"
 	"github.com/linkedin/goavro"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // CachedSchemaRegistryClient is a schema registry client that will cache some data to improve performance
@@ -10,38 +14,189 @@ type CachedSchemaRegistryClient struct {
 	SchemaRegistryClient *SchemaRegistryClient
 	schemaCache          map[int]*goavro.Codec
 	schemaCacheLock      sync.RWMutex
-	schemaIdCache        map[string]int
+	unsupportedCache     map[int]*ErrUnsupportedSchemaType
+	parsedCache          map[parsedKey]*avroSchema
+	parsedCacheLock      sync.RWMutex
+	schemaIdCache        map[subjectSchema]int
 	schemaIdCacheLock    sync.RWMutex
+	versionCache         map[subjectVersion]*goavro.Codec
+	versionCacheLock     sync.RWMutex
+	fingerprintCache     map[uint64]*goavro.Codec
+	fingerprintIds       map[uint64]int
+	fingerprintCacheLock sync.RWMutex
+	subjectsCache        map[int][]string
+	subjectsCacheLock    sync.RWMutex
+	latestIdCache        map[string]int
+	latestIdCacheLock    sync.RWMutex
+	refresherStop        chan struct{}
+	refresherDone        chan struct{}
+	refresherLock        sync.Mutex
+	fetches              int64
+
+	// CacheWarnThreshold logs a warning through Logger once the schema cache holds more entries, disabled when 0
+	CacheWarnThreshold int
+}
+
+type subjectVersion struct {
+	subject string
+	version int
+}
+
+// subjectSchema identifies a schema registered under a subject, registering it under another subject is a separate call
+type subjectSchema struct {
+	subject string
+	schema  string
+}
+
+// parsedKey identifies a cached codec by its schema id, or by its fingerprint when it has no id
+type parsedKey struct {
+	id          int
+	fingerprint uint64
 }
 
 func NewCachedSchemaRegistryClient(connect []string) *CachedSchemaRegistryClient {
-	SchemaRegistryClient := NewSchemaRegistryClient(connect)
-	return &CachedSchemaRegistryClient{SchemaRegistryClient: SchemaRegistryClient, schemaCache: make(map[int]*goavro.Codec), schemaIdCache: make(map[string]int)}
+	return newCachedSchemaRegistryClient(NewSchemaRegistryClient(connect))
 }
 
 func NewCachedSchemaRegistryClientWithRetries(connect []string, retries int) *CachedSchemaRegistryClient {
-	SchemaRegistryClient := NewSchemaRegistryClientWithRetries(connect, retries)
-	return &CachedSchemaRegistryClient{SchemaRegistryClient: SchemaRegistryClient, schemaCache: make(map[int]*goavro.Codec), schemaIdCache: make(map[string]int)}
+	return newCachedSchemaRegistryClient(NewSchemaRegistryClientWithRetries(connect, retries))
+}
+
+func newCachedSchemaRegistryClient(SchemaRegistryClient *SchemaRegistryClient) *CachedSchemaRegistryClient {
+	return &CachedSchemaRegistryClient{
+		SchemaRegistryClient: SchemaRegistryClient,
+		schemaCache:          make(map[int]*goavro.Codec),
+		unsupportedCache:     make(map[int]*ErrUnsupportedSchemaType),
+		parsedCache:          make(map[parsedKey]*avroSchema),
+		schemaIdCache:        make(map[subjectSchema]int),
+		versionCache:         make(map[subjectVersion]*goavro.Codec),
+		fingerprintCache:     make(map[uint64]*goavro.Codec),
+		fingerprintIds:       make(map[uint64]int),
+		subjectsCache:        make(map[int][]string),
+		latestIdCache:        make(map[string]int),
+	}
 }
 
-// GetSchema will return and cache the codec with the given id
+// GetSchema will return and cache the codec with the given id. Schemas of another type than avro are cached as well,
+// their *ErrUnsupportedSchemaType is returned without asking the registry again
 func (client *CachedSchemaRegistryClient) GetSchema(id int) (*goavro.Codec, error) {
 	client.schemaCacheLock.RLock()
 	cachedResult := client.schemaCache[id]
+	unsupported := client.unsupportedCache[id]
 	client.schemaCacheLock.RUnlock()
 	if nil != cachedResult {
 		return cachedResult, nil
 	}
+	if unsupported != nil {
+		return nil, unsupported
+	}
 	codec, err := client.SchemaRegistryClient.GetSchema(id)
+	if unsupported, ok := err.(*ErrUnsupportedSchemaType); ok {
+		// schemas are immutable, the type of the schema won't change
+		client.schemaCacheLock.Lock()
+		client.unsupportedCache[id] = unsupported
+		client.schemaCacheLock.Unlock()
+	}
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddInt64(&client.fetches, 1)
 	client.schemaCacheLock.Lock()
 	client.schemaCache[id] = codec
+	size := len(client.schemaCache)
 	client.schemaCacheLock.Unlock()
+	// schemas from the registry can decode values in single object encoding as well
+	if fingerprint, err := client.RegisterCodec(codec); err == nil {
+		client.fingerprintCacheLock.Lock()
+		client.fingerprintIds[fingerprint] = id
+		client.fingerprintCacheLock.Unlock()
+	}
+	if client.CacheWarnThreshold > 0 && size == client.CacheWarnThreshold+1 {
+		Logger.Printf("schema cache holds %d schemas, more than the threshold of %d", size, client.CacheWarnThreshold)
+	}
 	return codec, nil
 }
 
+// parsedSchema returns the parsed schema of a codec cached under the schema id, or under the fingerprint when id is 0,
+// parsing it only once. Like the codecs, parsed schemas are kept for the lifetime of the client
+func (client *CachedSchemaRegistryClient) parsedSchema(id int, fingerprint uint64, codec *goavro.Codec) (*avroSchema, error) {
+	key := parsedKey{id, fingerprint}
+	client.parsedCacheLock.RLock()
+	schema := client.parsedCache[key]
+	client.parsedCacheLock.RUnlock()
+	if schema != nil {
+		return schema, nil
+	}
+	schema, err := parseAvroSchema(codec.Schema())
+	if err != nil {
+		return nil, err
+	}
+	client.parsedCacheLock.Lock()
+	client.parsedCache[key] = schema
+	client.parsedCacheLock.Unlock()
+	return schema, nil
+}
+
+// RegisterCodec makes the codec available to decode values in single object encoding, e.g. for schemas that
+// are not in the registry. Schemas fetched by id are registered automatically
+func (client *CachedSchemaRegistryClient) RegisterCodec(codec *goavro.Codec) (uint64, error) {
+	fingerprint, err := Fingerprint(codec)
+	if err != nil {
+		return 0, err
+	}
+	client.RegisterCodecByFingerprint(fingerprint, codec)
+	return fingerprint, nil
+}
+
+// RegisterCodecByFingerprint is RegisterCodec with a fingerprint computed elsewhere, e.g. stored next to schema files
+func (client *CachedSchemaRegistryClient) RegisterCodecByFingerprint(fingerprint uint64, codec *goavro.Codec) {
+	client.fingerprintCacheLock.Lock()
+	client.fingerprintCache[fingerprint] = codec
+	client.fingerprintCacheLock.Unlock()
+}
+
+// GetCodecByFingerprint returns the codec registered for the fingerprint
+func (client *CachedSchemaRegistryClient) GetCodecByFingerprint(fingerprint uint64) (*goavro.Codec, bool) {
+	client.fingerprintCacheLock.RLock()
+	defer client.fingerprintCacheLock.RUnlock()
+	codec, ok := client.fingerprintCache[fingerprint]
+	return codec, ok
+}
+
+// schemaIdByFingerprint returns the id of the schema with the fingerprint, it is only known for schemas fetched by id
+func (client *CachedSchemaRegistryClient) schemaIdByFingerprint(fingerprint uint64) (int, bool) {
+	client.fingerprintCacheLock.RLock()
+	defer client.fingerprintCacheLock.RUnlock()
+	id, ok := client.fingerprintIds[fingerprint]
+	return id, ok
+}
+
+// CachedIDs returns the ids of the schemas in the cache in ascending order
+func (client *CachedSchemaRegistryClient) CachedIDs() []int {
+	client.schemaCacheLock.RLock()
+	ids := make([]int, 0, len(client.schemaCache))
+	for id := range client.schemaCache {
+		ids = append(ids, id)
+	}
+	client.schemaCacheLock.RUnlock()
+	sort.Ints(ids)
+	return ids
+}
+
+// GetSchemaRaw returns the registry's response for the schema with the given id as is, it is never cached
+func (client *CachedSchemaRegistryClient) GetSchemaRaw(id int) (json.RawMessage, error) {
+	return client.SchemaRegistryClient.GetSchemaRaw(id)
+}
+
+// GetSchemaMetadata returns the doc, namespace and custom attributes of the schema with the given id, using the cached codec
+func (client *CachedSchemaRegistryClient) GetSchemaMetadata(id int) (map[string]interface{}, error) {
+	codec, err := client.GetSchema(id)
+	if err != nil {
+		return nil, err
+	}
+	return parseSchemaMetadata(codec.Schema())
+}
+
 // GetSubjects returns a list of subjects
 func (client *CachedSchemaRegistryClient) GetSubjects() ([]string, error) {
 	return client.SchemaRegistryClient.GetSubjects()
@@ -57,16 +212,116 @@ func (client *CachedSchemaRegistryClient) GetSchemaByVersion(subject string, ver
 	return client.SchemaRegistryClient.GetSchemaByVersion(subject, version)
 }
 
+// GetAllVersions returns the codec of every version of a subject, versions are immutable so their codecs are cached
+// while the list of versions is fetched on every call
+func (client *CachedSchemaRegistryClient) GetAllVersions(subject string) (map[int]*goavro.Codec, error) {
+	versions, err := client.GetVersions(subject)
+	if err != nil {
+		return nil, err
+	}
+	codecs := make(map[int]*goavro.Codec, len(versions))
+	for _, version := range versions {
+		key := subjectVersion{subject, version}
+		client.versionCacheLock.RLock()
+		codec := client.versionCache[key]
+		client.versionCacheLock.RUnlock()
+		if codec == nil {
+			if codec, err = client.SchemaRegistryClient.GetSchemaByVersion(subject, version); err != nil {
+				return nil, err
+			}
+			client.versionCacheLock.Lock()
+			client.versionCache[key] = codec
+			client.versionCacheLock.Unlock()
+		}
+		codecs[version] = codec
+	}
+	return codecs, nil
+}
+
 // GetLatestSchema returns the highest version schema for a subject
 func (client *CachedSchemaRegistryClient) GetLatestSchema(subject string) (*goavro.Codec, error) {
 	return client.SchemaRegistryClient.GetLatestSchema(subject)
 }
 
-// CreateSubject will return and cache the id with the given codec
+// GetLatestSchemaId returns the cached id of the latest version of a subject, it is only fetched when missing.
+// Use StartSubjectRefresher to pick up new versions
+func (client *CachedSchemaRegistryClient) GetLatestSchemaId(subject string) (int, error) {
+	client.latestIdCacheLock.RLock()
+	id, ok := client.latestIdCache[subject]
+	client.latestIdCacheLock.RUnlock()
+	if ok {
+		return id, nil
+	}
+	return client.refreshLatestSchemaId(subject)
+}
+
+func (client *CachedSchemaRegistryClient) refreshLatestSchemaId(subject string) (int, error) {
+	id, err := client.SchemaRegistryClient.GetLatestSchemaId(subject)
+	if err != nil {
+		return 0, err
+	}
+	client.latestIdCacheLock.Lock()
+	client.latestIdCache[subject] = id
+	client.latestIdCacheLock.Unlock()
+	return id, nil
+}
+
+// StartSubjectRefresher refreshes the latest ids of the subjects in the background every interval,
+// so GetLatestSchemaId never blocks on the registry. A running refresher is replaced, ErrInvalidInterval is
+// returned and the running refresher kept when interval isn't positive
+func (client *CachedSchemaRegistryClient) StartSubjectRefresher(subjects []string, interval time.Duration) error {
+	if interval <= 0 {
+		return ErrInvalidInterval
+	}
+	client.refresherLock.Lock()
+	defer client.refresherLock.Unlock()
+	client.stopSubjectRefresher()
+	stop, done := make(chan struct{}), make(chan struct{})
+	client.refresherStop, client.refresherDone = stop, done
+	refresh := func() {
+		for _, subject := range subjects {
+			if _, err := client.refreshLatestSchemaId(subject); err != nil {
+				Logger.Printf("cannot refresh the latest schema of subject %s: %s", subject, err)
+			}
+		}
+	}
+	refresh()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				refresh()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// StopSubjectRefresher stops the refresher started by StartSubjectRefresher and waits for it to exit, the cached ids are kept
+func (client *CachedSchemaRegistryClient) StopSubjectRefresher() {
+	client.refresherLock.Lock()
+	defer client.refresherLock.Unlock()
+	client.stopSubjectRefresher()
+}
+
+func (client *CachedSchemaRegistryClient) stopSubjectRefresher() {
+	if client.refresherStop != nil {
+		close(client.refresherStop)
+		<-client.refresherDone
+		client.refresherStop, client.refresherDone = nil, nil
+	}
+}
+
+// CreateSubject will return and cache the id with the given subject and codec
 func (client *CachedSchemaRegistryClient) CreateSubject(subject string, codec *goavro.Codec) (int, error) {
-	schemaJson := codec.Schema()
+	key := subjectSchema{subject, codec.Schema()}
 	client.schemaIdCacheLock.RLock()
-	cachedResult, found := client.schemaIdCache[schemaJson]
+	cachedResult, found := client.schemaIdCache[key]
 	client.schemaIdCacheLock.RUnlock()
 	if found {
 		return cachedResult, nil
@@ -76,7 +331,7 @@ func (client *CachedSchemaRegistryClient) CreateSubject(subject string, codec *g
 		return 0, err
 	}
 	client.schemaIdCacheLock.Lock()
-	client.schemaIdCache[schemaJson] = id
+	client.schemaIdCache[key] = id
 	client.schemaIdCacheLock.Unlock()
 	return id, nil
 }
@@ -91,6 +346,34 @@ func (client *CachedSchemaRegistryClient) DeleteSubject(subject string) error {
 	return client.SchemaRegistryClient.DeleteSubject(subject)
 }
 
+// GetSubjectsBySchemaId returns and caches the subjects the schema with the given id is registered under
+func (client *CachedSchemaRegistryClient) GetSubjectsBySchemaId(id int) ([]string, error) {
+	client.subjectsCacheLock.RLock()
+	cachedResult, ok := client.subjectsCache[id]
+	client.subjectsCacheLock.RUnlock()
+	if ok {
+		return cachedResult, nil
+	}
+	subjects, err := client.SchemaRegistryClient.GetSubjectsBySchemaId(id)
+	if err != nil {
+		return nil, err
+	}
+	client.subjectsCacheLock.Lock()
+	client.subjectsCache[id] = subjects
+	client.subjectsCacheLock.Unlock()
+	return subjects, nil
+}
+
+// GetReferencedBy returns the ids of the schemas that reference a specific version of a subject
+func (client *CachedSchemaRegistryClient) GetReferencedBy(subject string, version int) ([]int, error) {
+	return client.SchemaRegistryClient.GetReferencedBy(subject, version)
+}
+
+// LookupSchemaUnderSubject returns the id and version of a schema registered under a subject
+func (client *CachedSchemaRegistryClient) LookupSchemaUnderSubject(subject string, schema string) (int, int, error) {
+	return client.SchemaRegistryClient.LookupSchemaUnderSubject(subject, schema)
+}
+
 // DeleteVersion deletes the a specific version of a subject, should only be used in development.
 func (client *CachedSchemaRegistryClient) DeleteVersion(subject string, version int) error {
 	return client.SchemaRegistryClient.DeleteVersion(subject, version)
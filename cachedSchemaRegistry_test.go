@@ -1,7 +1,14 @@
 package kafka
 
 import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
 )
 
 func TestCachedSchemaRegistryClient_GetSchema(t *testing.T) {
@@ -100,6 +107,10 @@ func TestCachedSchemaRegistryClient_CreateSubject(t *testing.T) {
 	if testObject.Count > 1 {
 		t.Errorf("Expected call count of 1, got %d", testObject.Count)
 	}
+	// the mock registry only knows the test subject
+	if _, err := client.CreateSubject("other", testObject.Codec); err == nil || testObject.Count < 2 {
+		t.Errorf("Expected the schema to be registered under the other subject as well, got %d calls", testObject.Count)
+	}
 }
 
 func TestCachedSchemaRegistryClient_IsSchemaRegistered(t *testing.T) {
@@ -140,3 +151,262 @@ func TestCachedSchemaRegistryClient_DeleteVersion(t *testing.T) {
 		t.Errorf("Error delete version: %v", err)
 	}
 }
+
+func TestCachedSchemaRegistryClient_GetReferencedBy(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	ids, err := client.GetReferencedBy(testObject.Subject, 1)
+	if nil != err {
+		t.Errorf("Error getting referencing schemas: %v", err)
+	}
+	if !containsInt(ids, testObject.Id+1) {
+		t.Errorf("Could not find referencing schema id")
+	}
+}
+
+func TestCachedSchemaRegistryClient_LookupSchemaUnderSubject(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	id, version, err := client.LookupSchemaUnderSubject(testObject.Subject, testObject.Codec.Schema())
+	if nil != err {
+		t.Errorf("Error looking up schema: %v", err)
+	}
+	if id != testObject.Id {
+		t.Errorf("Ids do not match. Expected: %d, got: %d", testObject.Id, id)
+	}
+	if version != 1 {
+		t.Errorf("Versions do not match. Expected: 1, got: %d", version)
+	}
+}
+
+func TestCachedSchemaRegistryClient_GetSchemaMetadata(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	client.GetSchema(1)
+	metadata, err := client.GetSchemaMetadata(1)
+	if nil != err {
+		t.Errorf("Error getting schema metadata: %v", err)
+	}
+	expected := map[string]interface{}{"doc": "test record", "namespace": "test.ns", "owner": "team"}
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("Metadata did not match expected %v, got %v", expected, metadata)
+	}
+	if testObject.Count > 1 {
+		t.Errorf("Expected call count of 1, got %d", testObject.Count)
+	}
+}
+
+func TestCachedSchemaRegistryClient_GetAllVersions(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	codecs, err := client.GetAllVersions(testObject.Subject)
+	if nil != err {
+		t.Errorf("Error getting all versions: %v", err)
+	}
+	if len(codecs) != 1 || codecs[1] == nil || codecs[1].Schema() != testObject.Codec.Schema() {
+		t.Errorf("Expected the codec of version 1, got %v", codecs)
+	}
+	count := testObject.Count
+	if _, err := client.GetAllVersions(testObject.Subject); err != nil {
+		t.Errorf("Error getting all versions: %v", err)
+	}
+	if testObject.Count != count+1 {
+		t.Errorf("Expected only the versions to be fetched again, got %d calls", testObject.Count-count)
+	}
+}
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Print(v ...interface{}) { l.lines = append(l.lines, fmt.Sprint(v...)) }
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+func (l *testLogger) Println(v ...interface{}) { l.lines = append(l.lines, fmt.Sprintln(v...)) }
+
+func TestCachedSchemaRegistryClient_CacheWarnThreshold(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	logger := &testLogger{}
+	defer func(previous sarama.StdLogger) { Logger = previous }(Logger)
+	Logger = logger
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	client.CacheWarnThreshold = 1
+	client.schemaCache[2] = testObject.Codec
+	if _, err := client.GetSchema(testObject.Id); err != nil {
+		t.Errorf("Error getting schema: %v", err)
+	}
+	if len(logger.lines) != 1 {
+		t.Errorf("Expected a warning about the cache size, got %v", logger.lines)
+	}
+}
+
+func TestCachedSchemaRegistryClient_CachedIDs(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 3)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	if ids := client.CachedIDs(); len(ids) != 0 {
+		t.Errorf("Expected an empty cache, got %v", ids)
+	}
+	client.schemaCache[5] = testObject.Codec
+	if _, err := client.GetSchema(testObject.Id); err != nil {
+		t.Errorf("Error getting schema: %v", err)
+	}
+	if ids := client.CachedIDs(); !reflect.DeepEqual(ids, []int{3, 5}) {
+		t.Errorf("Expected cached ids [3 5], got %v", ids)
+	}
+}
+
+func TestCachedSchemaRegistryClient_RegisterCodecByFingerprint(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	if _, ok := client.GetCodecByFingerprint(42); ok {
+		t.Errorf("Expected no codec for an unknown fingerprint")
+	}
+	client.RegisterCodecByFingerprint(42, testObject.Codec)
+	if codec, ok := client.GetCodecByFingerprint(42); !ok || codec != testObject.Codec {
+		t.Errorf("Expected the registered codec")
+	}
+	codec, err := client.GetSchema(testObject.Id)
+	if err != nil {
+		t.Errorf("Error getting schema: %v", err)
+	}
+	fingerprint, err := Fingerprint(codec)
+	if err != nil {
+		t.Errorf("Error computing fingerprint: %v", err)
+	}
+	if cached, ok := client.GetCodecByFingerprint(fingerprint); !ok || cached != codec {
+		t.Errorf("Expected schemas fetched by id to be registered by fingerprint")
+	}
+}
+
+func TestCachedSchemaRegistryClient_OnSchemaFetched(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	fetched := map[int]string{}
+	client.SchemaRegistryClient.OnSchemaFetched = func(id int, schema string) { fetched[id] = schema }
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetSchema(testObject.Id); err != nil {
+			t.Errorf("Error getting schema: %v", err)
+		}
+	}
+	if len(fetched) != 1 || fetched[testObject.Id] != testObject.Codec.Schema() {
+		t.Errorf("Expected the schema to be reported once, got %v", fetched)
+	}
+}
+
+func TestCachedSchemaRegistryClient_GetLatestSchemaId(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	var fetches int32
+	client.SchemaRegistryClient.OnSchemaFetched = func(int, string) { atomic.AddInt32(&fetches, 1) }
+	for i := 0; i < 2; i++ {
+		id, err := client.GetLatestSchemaId(testObject.Subject)
+		if err != nil {
+			t.Errorf("Error getting latest schema id: %v", err)
+		}
+		if id != testObject.Id {
+			t.Errorf("Ids do not match. Expected: %d, got: %d", testObject.Id, id)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Expected the latest schema id to be fetched once, got %d", fetches)
+	}
+}
+
+func TestCachedSchemaRegistryClient_StartSubjectRefresher(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	mockServer := testObject.MockServer
+	defer mockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{mockServer.URL})
+	var fetches int32
+	client.SchemaRegistryClient.OnSchemaFetched = func(int, string) { atomic.AddInt32(&fetches, 1) }
+	if err := client.StartSubjectRefresher([]string{testObject.Subject}, 0); err != ErrInvalidInterval {
+		t.Errorf("Expected ErrInvalidInterval, got %v", err)
+	}
+	if err := client.StartSubjectRefresher([]string{testObject.Subject}, 10*time.Millisecond); err != nil {
+		t.Fatalf("Error starting refresher: %v", err)
+	}
+	if atomic.LoadInt32(&fetches) != 1 {
+		t.Errorf("Expected the subjects to be refreshed on start")
+	}
+	id, err := client.GetLatestSchemaId(testObject.Subject)
+	if err != nil || id != testObject.Id {
+		t.Errorf("Expected the cached id %d, got %d (%v)", testObject.Id, id, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	client.StopSubjectRefresher()
+	refreshed := atomic.LoadInt32(&fetches)
+	if refreshed < 2 {
+		t.Errorf("Expected the subjects to be refreshed in the background, got %d fetches", refreshed)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&fetches) != refreshed {
+		t.Errorf("Expected no refresh after StopSubjectRefresher")
+	}
+}
+
+func TestCachedSchemaRegistryClient_StartSubjectRefresherConcurrently(t *testing.T) {
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	defer testObject.MockServer.Close()
+	client := NewCachedSchemaRegistryClient([]string{testObject.MockServer.URL})
+	var fetches int32
+	client.SchemaRegistryClient.OnSchemaFetched = func(int, string) { atomic.AddInt32(&fetches, 1) }
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.StartSubjectRefresher([]string{testObject.Subject}, 5*time.Millisecond); err != nil {
+				t.Errorf("Error starting refresher: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	client.StopSubjectRefresher()
+	refreshed := atomic.LoadInt32(&fetches)
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&fetches) != refreshed {
+		t.Errorf("Expected every refresher to be stopped")
+	}
+}
+
+func TestCachedSchemaRegistryClient_parsedSchema(t *testing.T) {
+	client := NewCachedSchemaRegistryClient([]string{"http://localhost:1"})
+	testObject := createSchemaRegistryTestObject(t, "test", 1)
+	defer testObject.MockServer.Close()
+	codec := testObject.Codec
+	byId, err := client.parsedSchema(1, 0, codec)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if byId.Name != "test.ns.test" {
+		t.Errorf("Expected the record name test.ns.test, got %q", byId.Name)
+	}
+	if cached, _ := client.parsedSchema(1, 0, codec); cached != byId {
+		t.Errorf("Expected the parsed schema to be cached by id")
+	}
+	if byFingerprint, _ := client.parsedSchema(0, 42, codec); byFingerprint == byId {
+		t.Errorf("Expected schemas without id to be cached by fingerprint")
+	}
+	if other := NewCachedSchemaRegistryClient([]string{"http://localhost:1"}); len(other.parsedCache) != 0 {
+		t.Errorf("Expected parsed schemas to be kept per client")
+	}
+}
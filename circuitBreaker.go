@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker decides when the consumer should stop pulling messages because the callbacks keep failing
+type CircuitBreaker interface {
+	// Failure records a failed callback and reports whether the circuit is open
+	Failure() bool
+	// Success records a successful callback and reports whether it closed an open circuit
+	Success() bool
+	// Cooldown returns how long consumption is paused every time the circuit opens
+	Cooldown() time.Duration
+}
+
+type consecutiveFailureBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	lock      sync.Mutex
+}
+
+// NewCircuitBreaker returns a breaker that opens after threshold consecutive failures and pauses consumption for cooldown.
+// After the cooldown the next message tests the downstream: a failure opens the circuit again, a success closes it
+func NewCircuitBreaker(threshold int, cooldown time.Duration) CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &consecutiveFailureBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Failure counts a consecutive failure, the circuit is open once the threshold is reached
+func (b *consecutiveFailureBreaker) Failure() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	return b.failures >= b.threshold
+}
+
+// Success resets the consecutive failures
+func (b *consecutiveFailureBreaker) Success() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	open := b.failures >= b.threshold
+	b.failures = 0
+	return open
+}
+
+// Cooldown returns the configured pause
+func (b *consecutiveFailureBreaker) Cooldown() time.Duration {
+	return b.cooldown
+}
@@ -0,0 +1,39 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_Threshold(t *testing.T) {
+	breaker := NewCircuitBreaker(3, time.Second)
+	for i := 1; i < 3; i++ {
+		if breaker.Failure() {
+			t.Errorf("Expected circuit to be closed after %d failures", i)
+		}
+	}
+	if !breaker.Failure() {
+		t.Errorf("Expected circuit to be open after 3 failures")
+	}
+	if breaker.Cooldown() != time.Second {
+		t.Errorf("Expected cooldown of %s, got %s", time.Second, breaker.Cooldown())
+	}
+}
+
+func TestCircuitBreaker_HalfOpen(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Second)
+	breaker.Failure()
+	breaker.Failure()
+	if !breaker.Failure() {
+		t.Errorf("Expected a failed test message to open the circuit again")
+	}
+	if !breaker.Success() {
+		t.Errorf("Expected a successful test message to close the circuit")
+	}
+	if breaker.Success() {
+		t.Errorf("Expected circuit to be closed already")
+	}
+	if breaker.Failure() {
+		t.Errorf("Expected failures to be reset after success")
+	}
+}
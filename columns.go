@@ -0,0 +1,83 @@
+package kafka
+
+import (
+	"fmt"
+)
+
+// primitiveTypes are the avro types DecodeColumns supports, alone or in a union with null
+var primitiveTypes = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true, "string": true,
+}
+
+// DecodeColumns decodes a batch of values framed with the same schema id into one column per top-level field of the
+// record schema, e.g. to load them into a columnar store without building rows first. Columns hold the native goavro
+// values, nullable unions hold nil or the plain value. Only fields of primitive types and their nullable unions
+// are supported, other fields fail with ErrUnsupportedColumnType, values of other schemas with ErrMixedSchemas
+func (ac *avroConsumer) DecodeColumns(values [][]byte) (map[string][]interface{}, error) {
+	if len(values) == 0 {
+		return map[string][]interface{}{}, nil
+	}
+	schemaId, err := ParseSchemaID(values[0])
+	if err != nil {
+		return nil, err
+	}
+	codec, err := ac.GetSchema(schemaId)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ac.SchemaRegistryClient.parsedSchema(schemaId, 0, codec)
+	if err != nil {
+		return nil, &DecodeError{SchemaId: schemaId, Err: err}
+	}
+	if schema.Type != "record" {
+		return nil, &DecodeError{SchemaId: schemaId, Err: ErrUnsupportedColumnType}
+	}
+	columns := make(map[string][]interface{}, len(schema.Fields))
+	for _, field := range schema.Fields {
+		if !field.Type.columnar() {
+			return nil, &DecodeError{SchemaId: schemaId, Field: field.Name, Err: ErrUnsupportedColumnType}
+		}
+		columns[field.Name] = make([]interface{}, 0, len(values))
+	}
+	for i, value := range values {
+		id, err := ParseSchemaID(value)
+		if err != nil {
+			return nil, &DecodeError{SchemaId: schemaId, Err: fmt.Errorf("record %d: %s", i, err)}
+		}
+		if id != schemaId {
+			return nil, &DecodeError{SchemaId: id, Err: ErrMixedSchemas}
+		}
+		native, _, err := codec.NativeFromBinary(value[5:])
+		if err != nil {
+			return nil, &DecodeError{SchemaId: schemaId, Err: fmt.Errorf("record %d: %s", i, err)}
+		}
+		record := native.(map[string]interface{})
+		for _, field := range schema.Fields {
+			columns[field.Name] = append(columns[field.Name], unwrapNullable(record[field.Name]))
+		}
+	}
+	return columns, nil
+}
+
+// columnar reports whether DecodeColumns supports fields of the schema
+func (schema *avroSchema) columnar() bool {
+	if schema.nullable() {
+		for _, branch := range schema.Branches {
+			if !primitiveTypes[branch.Type] {
+				return false
+			}
+		}
+		return true
+	}
+	return primitiveTypes[schema.Type]
+}
+
+// unwrapNullable returns the plain value of a native goavro union value, map[string]interface{}{"string": "x"}
+func unwrapNullable(value interface{}) interface{} {
+	if wrapped, ok := value.(map[string]interface{}); ok {
+		for _, v := range wrapped {
+			return v
+		}
+	}
+	return value
+}
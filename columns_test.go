@@ -0,0 +1,64 @@
+package kafka
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/linkedin/goavro"
+)
+
+func TestAvroConsumer_DecodeColumns(t *testing.T) {
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "test", "fields": [
+		{"name": "id", "type": "long"},
+		{"name": "name", "type": ["null", "string"]}]}`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{"http://localhost"})
+	schemaRegistryMock.schemaCache[2] = codec
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	var values [][]byte
+	for _, record := range []map[string]interface{}{
+		{"id": int64(1), "name": goavro.Union("string", "a")},
+		{"id": int64(2), "name": nil},
+	} {
+		binaryValue, err := codec.BinaryFromNative(nil, record)
+		if err != nil {
+			t.Fatalf("Error get binary from native: %v", err)
+		}
+		values = append(values, encodeAvroMsg(2, binaryValue))
+	}
+	columns, err := avroConsumer.DecodeColumns(values)
+	if err != nil {
+		t.Fatalf("Error decoding columns: %v", err)
+	}
+	expected := map[string][]interface{}{"id": {int64(1), int64(2)}, "name": {"a", nil}}
+	if !reflect.DeepEqual(columns, expected) {
+		t.Errorf("Expected %v, got %v", expected, columns)
+	}
+	schemaRegistryMock.schemaCache[3] = codec
+	_, err = avroConsumer.DecodeColumns(append(values, encodeAvroMsg(3, values[0][5:])))
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrMixedSchemas || decodeErr.SchemaId != 3 {
+		t.Errorf("Expected ErrMixedSchemas, got %v", err)
+	}
+}
+
+func TestAvroConsumer_DecodeColumnsUnsupported(t *testing.T) {
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "test", "fields": [
+		{"name": "id", "type": "long"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}}]}`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{"http://localhost"})
+	schemaRegistryMock.schemaCache[2] = codec
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	binaryValue, err := codec.BinaryFromNative(nil, map[string]interface{}{"id": int64(1), "tags": []interface{}{}})
+	if err != nil {
+		t.Fatalf("Error get binary from native: %v", err)
+	}
+	_, err = avroConsumer.DecodeColumns([][]byte{encodeAvroMsg(2, binaryValue)})
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrUnsupportedColumnType || decodeErr.Field != "tags" {
+		t.Errorf("Expected ErrUnsupportedColumnType for tags, got %v", err)
+	}
+}
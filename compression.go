@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// BodyCompression is the codec of avro bodies compressed like the blocks of avro object container files.
+// It only applies to the body after the schema registry or single object encoding framing, kafka's own
+// compression is handled by sarama. Standard Confluent serializers never compress the body
+type BodyCompression string
+
+const (
+	// BodyCompressionDeflate is raw deflate (RFC 1951) without zlib or gzip headers
+	BodyCompressionDeflate BodyCompression = "deflate"
+	// BodyCompressionSnappy is a snappy block followed by the big endian CRC32 of the uncompressed body
+	BodyCompressionSnappy BodyCompression = "snappy"
+)
+
+// defaultMaxDecompressedSize is the size bodies may decompress to when MaxDecompressedSize isn't set
+const defaultMaxDecompressedSize = 64 << 20
+
+// decompressValue returns the value with its framing kept and its body decompressed to at most maxSize bytes
+func decompressValue(value []byte, compression BodyCompression, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedSize
+	}
+	body := avroBody(value)
+	framing := value[:len(value)-len(body)]
+	var decompressed []byte
+	var err error
+	switch compression {
+	case BodyCompressionDeflate:
+		// read one byte more than allowed to tell a body of exactly maxSize bytes from a larger one
+		decompressed, err = ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(body)), int64(maxSize)+1))
+		if err == nil && len(decompressed) > maxSize {
+			err = ErrDecompressedTooLarge
+		}
+	case BodyCompressionSnappy:
+		decompressed, err = decompressSnappy(body, maxSize)
+	default:
+		return nil, &ErrUnsupportedBodyCompression{Compression: compression}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(append(make([]byte, 0, len(framing)+len(decompressed)), framing...), decompressed...), nil
+}
+
+func decompressSnappy(body []byte, maxSize int) ([]byte, error) {
+	if len(body) < crc32.Size {
+		return nil, ErrBodyChecksum
+	}
+	block, checksum := body[:len(body)-crc32.Size], body[len(body)-crc32.Size:]
+	// the block starts with its decoded length, check it before snappy allocates it
+	size, err := snappy.DecodedLen(block)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	decompressed, err := snappy.Decode(nil, block)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(decompressed) != binary.BigEndian.Uint32(checksum) {
+		return nil, ErrBodyChecksum
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,83 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/golang/snappy"
+)
+
+func compressTestBody(t *testing.T, value []byte, compression BodyCompression) []byte {
+	body := value[5:]
+	compressed := append([]byte{}, value[:5]...)
+	switch compression {
+	case BodyCompressionDeflate:
+		var buf bytes.Buffer
+		writer, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			t.Fatalf("Error creating deflate writer: %v", err)
+		}
+		writer.Write(body)
+		writer.Close()
+		compressed = append(compressed, buf.Bytes()...)
+	case BodyCompressionSnappy:
+		compressed = append(compressed, snappy.Encode(nil, body)...)
+		checksum := make([]byte, crc32.Size)
+		binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(body))
+		compressed = append(compressed, checksum...)
+	}
+	return compressed
+}
+
+func TestAvroConsumer_BodyCompression(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	value := getTestAvroMsg(t, schemaRegistryTestObject.Codec)
+	for _, compression := range []BodyCompression{BodyCompressionDeflate, BodyCompressionSnappy} {
+		avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+		avroConsumer.BodyCompression = compression
+		avroConsumer.KeepRawMessage = true
+		consumerMsg := &sarama.ConsumerMessage{Value: compressTestBody(t, value, compression), Topic: "test"}
+		msg, err := avroConsumer.ProcessAvroMsg(consumerMsg)
+		if err != nil {
+			t.Errorf("Error process %s compressed msg: %v", compression, err)
+			continue
+		}
+		if msg.Value != testData {
+			t.Errorf("Expected %s, got %s", testData, msg.Value)
+		}
+		if msg.Raw != consumerMsg {
+			t.Errorf("Expected the raw message to keep the compressed value")
+		}
+	}
+}
+
+func TestDecompressValue_Errors(t *testing.T) {
+	value := compressTestBody(t, []byte{0, 0, 0, 0, 1, 2, 'a', 'b'}, BodyCompressionSnappy)
+	value[len(value)-1]++
+	if _, err := decompressValue(value, BodyCompressionSnappy, 0); err != ErrBodyChecksum {
+		t.Errorf("Expected ErrBodyChecksum, got %v", err)
+	}
+	if _, err := decompressValue(value, "lz4", 0); err == nil {
+		t.Errorf("Expected an unsupported body compression error")
+	} else if unsupported, ok := err.(*ErrUnsupportedBodyCompression); !ok || unsupported.Compression != "lz4" {
+		t.Errorf("Expected ErrUnsupportedBodyCompression, got %v", err)
+	}
+}
+
+func TestDecompressValue_MaxSize(t *testing.T) {
+	value := append([]byte{0, 0, 0, 0, 1}, bytes.Repeat([]byte{'a'}, 100)...)
+	for _, compression := range []BodyCompression{BodyCompressionDeflate, BodyCompressionSnappy} {
+		compressed := compressTestBody(t, value, compression)
+		if _, err := decompressValue(compressed, compression, 99); err != ErrDecompressedTooLarge {
+			t.Errorf("Expected ErrDecompressedTooLarge for %s, got %v", compression, err)
+		}
+		if decompressed, err := decompressValue(compressed, compression, 100); err != nil || !bytes.Equal(decompressed, value) {
+			t.Errorf("Expected %s body of exactly the maximum size to decompress, got %v", compression, err)
+		}
+	}
+}
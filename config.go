@@ -0,0 +1,153 @@
+package kafka
+
+import (
+	"net"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+)
+
+// SetGroupTimeouts sets the session timeout and heartbeat interval of a consumer group config.
+// The heartbeat has to be at most a third of the session timeout, so a member survives two missed heartbeats
+// before the broker rebalances the group. sarama-cluster joins groups with the session timeout as rebalance timeout,
+// a rebalance has to complete within the session timeout as well.
+// The config is left untouched when the timeouts are invalid
+func SetGroupTimeouts(config *cluster.Config, session time.Duration, heartbeat time.Duration) error {
+	switch {
+	case session < time.Millisecond:
+		return sarama.ConfigurationError("Group.Session.Timeout must be >= 1ms")
+	case heartbeat < time.Millisecond:
+		return sarama.ConfigurationError("Group.Heartbeat.Interval must be >= 1ms")
+	case heartbeat > session/3:
+		return sarama.ConfigurationError("Group.Heartbeat.Interval must be <= Group.Session.Timeout / 3")
+	}
+	config.Group.Session.Timeout = session
+	config.Group.Heartbeat.Interval = heartbeat
+	return nil
+}
+
+// CommitBeforeRevoke makes sure messages being processed when the group rebalances are committed before their
+// partitions are revoked. sarama-cluster stops fetching, waits Group.Offsets.Synchronization.DwellTime for messages
+// to be marked and then commits synchronously, marks after that are lost and the messages are consumed again by the
+// next owner. maxProcessingTime is the longest a callback, or MaxInFlight callbacks, take to finish, it has to be
+// shorter than the session timeout. The consumer logs a warning when messages are still in flight after the commit.
+// sarama-cluster waits the full DwellTime on every rebalance, including the first join, even when nothing is in
+// flight, so every rebalance takes that much longer. Close doesn't wait, it commits the marks made so far right away
+func CommitBeforeRevoke(config *cluster.Config, maxProcessingTime time.Duration) error {
+	switch {
+	case maxProcessingTime <= 0:
+		return sarama.ConfigurationError("Group.Offsets.Synchronization.DwellTime must be > 0")
+	case maxProcessingTime > 10*time.Minute:
+		return sarama.ConfigurationError("Group.Offsets.Synchronization.DwellTime must be <= 10m")
+	case maxProcessingTime >= config.Group.Session.Timeout:
+		return sarama.ConfigurationError("Group.Offsets.Synchronization.DwellTime must be < Group.Session.Timeout")
+	}
+	config.Group.Offsets.Synchronization.DwellTime = maxProcessingTime
+	return nil
+}
+
+// SetIsolationLevel sets which records of transactional producers a consumer reads. sarama.ReadCommitted skips records
+// of aborted transactions and holds back records of open ones, it requires config.Version 0.11 or later.
+// The config is left untouched when the level is invalid
+func SetIsolationLevel(config *cluster.Config, level sarama.IsolationLevel) error {
+	switch {
+	case level != sarama.ReadUncommitted && level != sarama.ReadCommitted:
+		return sarama.ConfigurationError("Consumer.IsolationLevel must be ReadUncommitted or ReadCommitted")
+	case level == sarama.ReadCommitted && !config.Version.IsAtLeast(sarama.V0_11_0_0):
+		return sarama.ConfigurationError("ReadCommitted requires Version >= V0_11_0_0")
+	}
+	config.Consumer.IsolationLevel = level
+	return nil
+}
+
+// SetMetadataRetry sets how often and how far apart fetching cluster metadata is retried, e.g. while a partition
+// leader is being elected. It also spaces the attempts of NewAvroConsumerWithConnectTimeout.
+// The config is left untouched when the values are invalid
+func SetMetadataRetry(config *cluster.Config, max int, backoff time.Duration) error {
+	switch {
+	case max < 0:
+		return sarama.ConfigurationError("Metadata.Retry.Max must be >= 0")
+	case backoff <= 0:
+		return sarama.ConfigurationError("Metadata.Retry.Backoff must be > 0")
+	}
+	config.Metadata.Retry.Max = max
+	config.Metadata.Retry.Backoff = backoff
+	return nil
+}
+
+// SetBrokerDialer connects to brokers with dial instead of a net.Dialer, e.g. to tunnel connections.
+// TLS is still negotiated by sarama on top of the returned connection
+func SetBrokerDialer(config *cluster.Config, dial func(network, address string) (net.Conn, error)) {
+	config.Net.Proxy.Enable = true
+	config.Net.Proxy.Dialer = dialFunc(dial)
+}
+
+// SetBrokerAddressMapper connects to brokers at the address mapAddress returns for the host:port they advertise,
+// e.g. when brokers advertise internal host names of a split horizon DNS. It applies to the bootstrap servers as well.
+// TLS still verifies the advertised host name, connections honor Net.DialTimeout, Net.KeepAlive and Net.LocalAddr
+func SetBrokerAddressMapper(config *cluster.Config, mapAddress func(address string) string) {
+	dialer := &net.Dialer{Timeout: config.Net.DialTimeout, KeepAlive: config.Net.KeepAlive, LocalAddr: config.Net.LocalAddr}
+	SetBrokerDialer(config, func(network, address string) (net.Conn, error) {
+		return dialer.Dial(network, mapAddress(address))
+	})
+}
+
+// dialFunc adapts a function to the dialer of sarama's Net.Proxy
+type dialFunc func(network, address string) (net.Conn, error)
+
+func (dial dialFunc) Dial(network, address string) (net.Conn, error) {
+	return dial(network, address)
+}
+
+// String describes the dialer in sarama's logs
+func (dial dialFunc) String() string {
+	return "custom broker dialer"
+}
+
+// connect calls newClient until it succeeds or connectTimeout passed, attempts are backoff apart.
+// Only sarama.ErrOutOfBrokers is retried, it means none of the servers could be reached
+func connect(newClient func() error, connectTimeout time.Duration, backoff time.Duration) error {
+	deadline := time.Now().Add(connectTimeout)
+	for {
+		err := newClient()
+		if err != sarama.ErrOutOfBrokers || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		Logger.Printf("cannot reach the kafka servers, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
+// warnUnsupportedHeaders logs when message headers can't be consumed, because config.Version is older than 0.11
+// or a broker doesn't support fetch requests with headers
+func warnUnsupportedHeaders(client sarama.Client) {
+	config := client.Config()
+	if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		Logger.Printf("config.Version %s is older than 0.11.0.0, message headers are not consumed", config.Version)
+		return
+	}
+	for _, broker := range client.Brokers() {
+		if err := broker.Open(config); err != nil && err != sarama.ErrAlreadyConnected {
+			continue
+		}
+		res, err := broker.ApiVersions(&sarama.ApiVersionsRequest{})
+		if err != nil {
+			Logger.Printf("cannot detect the api versions of broker %s: %s", broker.Addr(), err)
+			continue
+		}
+		if !supportsHeaders(res) {
+			Logger.Printf("broker %s is older than 0.11.0.0, message headers are not consumed", broker.Addr())
+		}
+	}
+}
+
+// supportsHeaders reports whether the broker supports fetch requests (api key 1) v4+, which return message headers
+func supportsHeaders(res *sarama.ApiVersionsResponse) bool {
+	for _, api := range res.ApiVersions {
+		if api.ApiKey == 1 {
+			return api.MaxVersion >= 4
+		}
+	}
+	return false
+}
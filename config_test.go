@@ -0,0 +1,253 @@
+package kafka
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+)
+
+func TestSetGroupTimeouts(t *testing.T) {
+	tests := []struct {
+		name      string
+		session   time.Duration
+		heartbeat time.Duration
+		valid     bool
+	}{
+		{"valid", 30 * time.Second, 10 * time.Second, true},
+		{"heartbeat too long", 30 * time.Second, 11 * time.Second, false},
+		{"missing heartbeat", 30 * time.Second, 0, false},
+		{"missing session", 0, 0, false},
+	}
+	for _, test := range tests {
+		config := NewDefaultConfig()
+		session, heartbeat := config.Group.Session.Timeout, config.Group.Heartbeat.Interval
+		err := SetGroupTimeouts(config, test.session, test.heartbeat)
+		if test.valid {
+			if err != nil || config.Group.Session.Timeout != test.session || config.Group.Heartbeat.Interval != test.heartbeat {
+				t.Errorf("%s: expected timeouts to be set, got %v", test.name, err)
+			}
+		} else if err == nil || config.Group.Session.Timeout != session || config.Group.Heartbeat.Interval != heartbeat {
+			t.Errorf("%s: expected an error and an untouched config", test.name)
+		}
+	}
+}
+
+func TestWarnUnsupportedHeaders(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+		"ApiVersionsRequest": sarama.NewMockWrapper(&sarama.ApiVersionsResponse{
+			ApiVersions: []*sarama.ApiVersionsResponseBlock{{ApiKey: 1, MinVersion: 0, MaxVersion: 3}},
+		}),
+	})
+	logger := &testLogger{}
+	previous := Logger
+	defer func() { Logger = previous }()
+	Logger = logger
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	defer client.Close()
+	warnUnsupportedHeaders(client)
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "headers are not consumed") {
+		t.Errorf("Expected a warning about headers, got %v", logger.lines)
+	}
+}
+
+func TestCommitBeforeRevoke(t *testing.T) {
+	config := NewDefaultConfig()
+	if err := CommitBeforeRevoke(config, 5*time.Second); err != nil {
+		t.Errorf("Error setting dwell time: %v", err)
+	}
+	if config.Group.Offsets.Synchronization.DwellTime != 5*time.Second {
+		t.Errorf("Expected dwell time of 5s, got %s", config.Group.Offsets.Synchronization.DwellTime)
+	}
+	if err := CommitBeforeRevoke(config, config.Group.Session.Timeout); err == nil {
+		t.Errorf("Expected an error for a dwell time as long as the session timeout")
+	}
+}
+
+// TestCommitBeforeRevoke_MarkWithinDwellTime marks a message after the group started rebalancing, sarama-cluster
+// has to commit it once DwellTime is over
+func TestCommitBeforeRevoke_MarkWithinDwellTime(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	// the member is assigned partition 0 of topic test by the group leader
+	assignment := []byte{0, 0, 0, 0, 0, 1, 0, 4, 't', 'e', 's', 't', 0, 0, 0, 1, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}
+	fetch := &sarama.FetchResponse{Version: 1}
+	fetch.AddMessage("test", 0, nil, sarama.StringEncoder("value"), 0)
+	fetch.GetBlock("test", 0).HighWaterMarkOffset = 1
+	handlers := map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("test", 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"JoinGroupRequest": sarama.NewMockWrapper(&sarama.JoinGroupResponse{
+			GenerationId: 1, GroupProtocol: "range", LeaderId: "leader", MemberId: "member",
+		}),
+		"SyncGroupRequest": sarama.NewMockWrapper(&sarama.SyncGroupResponse{MemberAssignment: assignment}),
+		"HeartbeatRequest": sarama.NewMockWrapper(&sarama.HeartbeatResponse{}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group", "test", 0, 0, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("test", 0, sarama.OffsetOldest, 0).
+			SetOffset("test", 0, sarama.OffsetNewest, 1),
+		"FetchRequest":        sarama.NewMockWrapper(fetch),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockWrapper(&sarama.LeaveGroupResponse{}),
+	}
+	broker.SetHandlerByMap(handlers)
+	config := NewDefaultConfig()
+	config.Group.Heartbeat.Interval = 50 * time.Millisecond
+	config.Consumer.Offsets.CommitInterval = time.Hour
+	config.Group.Return.Notifications = false
+	config.Version = sarama.V0_9_0_0
+	if err := CommitBeforeRevoke(config, time.Second); err != nil {
+		t.Fatalf("Error setting dwell time: %v", err)
+	}
+	consumer, err := cluster.NewConsumer([]string{broker.Addr()}, "group", []string{"test"}, config)
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	defer consumer.Close()
+	var msg *sarama.ConsumerMessage
+	select {
+	case msg = <-consumer.Messages():
+	case err := <-consumer.Errors():
+		t.Fatalf("Error consuming: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected a message")
+	}
+	rebalancing := map[string]sarama.MockResponse{
+		"HeartbeatRequest": sarama.NewMockWrapper(&sarama.HeartbeatResponse{Err: sarama.ErrRebalanceInProgress}),
+	}
+	for name, handler := range handlers {
+		if _, ok := rebalancing[name]; !ok {
+			rebalancing[name] = handler
+		}
+	}
+	broker.SetHandlerByMap(rebalancing)
+	// the next heartbeat starts the rebalance, the commit has to happen by the end of DwellTime and not a later one
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	consumer.MarkOffset(msg, "")
+	for time.Now().Before(deadline) {
+		for _, rr := range broker.History() {
+			if req, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+				if offset, _, err := req.Offset("test", 0); err == nil && offset == msg.Offset+1 {
+					return
+				}
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("Expected the mark to be committed as DwellTime ended")
+}
+
+func TestSetIsolationLevel(t *testing.T) {
+	config := NewDefaultConfig()
+	config.Version = sarama.V0_9_0_0
+	if err := SetIsolationLevel(config, sarama.ReadCommitted); err == nil || config.Consumer.IsolationLevel != sarama.ReadUncommitted {
+		t.Errorf("Expected an error and an untouched config before 0.11")
+	}
+	config.Version = sarama.V0_11_0_0
+	if err := SetIsolationLevel(config, sarama.ReadCommitted); err != nil || config.Consumer.IsolationLevel != sarama.ReadCommitted {
+		t.Errorf("Expected ReadCommitted to be set, got %v", err)
+	}
+	if err := SetIsolationLevel(config, sarama.IsolationLevel(5)); err == nil || config.Consumer.IsolationLevel != sarama.ReadCommitted {
+		t.Errorf("Expected an error and an untouched config for an unknown level")
+	}
+}
+
+func TestSetMetadataRetry(t *testing.T) {
+	config := NewDefaultConfig()
+	if err := SetMetadataRetry(config, 10, 500*time.Millisecond); err != nil {
+		t.Errorf("Error setting metadata retry: %v", err)
+	}
+	if config.Metadata.Retry.Max != 10 || config.Metadata.Retry.Backoff != 500*time.Millisecond {
+		t.Errorf("Expected the metadata retry to be set, got %d, %s", config.Metadata.Retry.Max, config.Metadata.Retry.Backoff)
+	}
+	if err := SetMetadataRetry(config, -1, time.Second); err == nil || config.Metadata.Retry.Max != 10 {
+		t.Errorf("Expected an error and an untouched config for a negative max")
+	}
+	if err := SetMetadataRetry(config, 5, 0); err == nil || config.Metadata.Retry.Max != 10 || config.Metadata.Retry.Backoff != 500*time.Millisecond {
+		t.Errorf("Expected an error and an untouched config for a zero backoff")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	attempts := 0
+	err := connect(func() error {
+		if attempts++; attempts < 3 {
+			return sarama.ErrOutOfBrokers
+		}
+		return nil
+	}, time.Second, time.Millisecond)
+	if err != nil || attempts != 3 {
+		t.Errorf("Expected to connect on the third attempt, got %d attempts, %v", attempts, err)
+	}
+	attempts = 0
+	err = connect(func() error {
+		attempts++
+		return sarama.ConfigurationError("invalid")
+	}, time.Second, time.Millisecond)
+	if err == nil || attempts != 1 {
+		t.Errorf("Expected configuration errors not to be retried, got %d attempts", attempts)
+	}
+	attempts = 0
+	err = connect(func() error {
+		attempts++
+		return sarama.ErrOutOfBrokers
+	}, 0, time.Millisecond)
+	if err != sarama.ErrOutOfBrokers || attempts != 1 {
+		t.Errorf("Expected a single attempt without a connect timeout, got %d attempts, %v", attempts, err)
+	}
+}
+
+func TestSetBrokerAddressMapper(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker("kafka-1.internal:9092", broker.BrokerID()),
+	})
+	var lock sync.Mutex
+	mapped := map[string]bool{}
+	config := NewDefaultConfig()
+	SetBrokerAddressMapper(config, func(address string) string {
+		lock.Lock()
+		mapped[address] = true
+		lock.Unlock()
+		return broker.Addr()
+	})
+	client, err := sarama.NewClient([]string{"bootstrap.internal:9092"}, &config.Config)
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	defer client.Close()
+	brokers := client.Brokers()
+	if len(brokers) != 1 || brokers[0].Addr() != "kafka-1.internal:9092" {
+		t.Fatalf("Expected the advertised broker, got %v", brokers)
+	}
+	if err := brokers[0].Open(&config.Config); err != nil {
+		t.Fatalf("Error opening broker: %v", err)
+	}
+	if connected, err := brokers[0].Connected(); !connected {
+		t.Errorf("Expected to reach the advertised broker through the mapped address, got %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !mapped["bootstrap.internal:9092"] || !mapped["kafka-1.internal:9092"] {
+		t.Errorf("Expected the bootstrap and advertised addresses to be mapped, got %v", mapped)
+	}
+}
@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// defaultErrorSummaryInterval is how often OnErrorSummary is called when ErrorSummaryInterval isn't set
+const defaultErrorSummaryInterval = time.Minute
+
+// errorSummary counts the errors reported since the last summary by cause
+type errorSummary struct {
+	lock   sync.Mutex
+	counts map[string]int
+	since  time.Time
+}
+
+func newErrorSummary() *errorSummary {
+	return &errorSummary{counts: make(map[string]int), since: time.Now()}
+}
+
+func (s *errorSummary) add(err error) {
+	s.lock.Lock()
+	s.counts[errorCause(err)]++
+	s.lock.Unlock()
+}
+
+// flush returns the counts and the time since the previous flush, and starts a new window
+func (s *errorSummary) flush() (map[string]int, time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counts, window := s.counts, time.Since(s.since)
+	s.counts, s.since = make(map[string]int), time.Now()
+	return counts, window
+}
+
+// errorCause returns the message of the cause of an error, without the topic, partition and offset
+// of the message that failed, so errors of the same kind are counted together
+func errorCause(err error) string {
+	switch e := err.(type) {
+	case *DecodeError:
+		return e.Err.Error()
+	case *sarama.ConsumerError:
+		return e.Err.Error()
+	}
+	return err.Error()
+}
+
+// startErrorSummaries calls OnErrorSummary every ErrorSummaryInterval until the returned function is called,
+// which reports the errors counted since the last summary
+func (ac *avroConsumer) startErrorSummaries() func() {
+	if ac.callbacks.OnErrorSummary == nil {
+		return func() {}
+	}
+	interval := ac.ErrorSummaryInterval
+	if interval <= 0 {
+		interval = defaultErrorSummaryInterval
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ac.reportErrorSummary()
+			case <-stop:
+				ac.reportErrorSummary()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (ac *avroConsumer) reportErrorSummary() {
+	if counts, window := ac.errorSummary.flush(); len(counts) > 0 {
+		ac.callbacks.OnErrorSummary(counts, window)
+	}
+}
@@ -0,0 +1,67 @@
+package kafka
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestAvroConsumer_OnErrorSummary(t *testing.T) {
+	summaries := make(chan map[string]int, 10)
+	var reported int32
+	callbacks := ConsumerCallbacks{
+		OnDataReceived: func(msg Message) {},
+		OnError:        func(err error) { atomic.AddInt32(&reported, 1) },
+		OnErrorSummary: func(counts map[string]int, window time.Duration) {
+			if window <= 0 {
+				t.Errorf("Expected a positive window, got %s", window)
+			}
+			summaries <- counts
+		},
+	}
+	mockConsumer := newMockClusterConsumer()
+	avroConsumer := newAvroConsumer(mockConsumer, nil, callbacks, NewDefaultConfig())
+	avroConsumer.ErrorSummaryInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		avroConsumer.Consume()
+		close(done)
+	}()
+	mockConsumer.errors <- &sarama.ConsumerError{Topic: "test", Partition: 1, Err: sarama.ErrOutOfBrokers}
+	mockConsumer.errors <- &DecodeError{Topic: "test", Offset: 1, Err: ErrZeroSchemaId}
+	mockConsumer.errors <- &DecodeError{Topic: "test", Offset: 2, Err: ErrZeroSchemaId}
+	expected := map[string]int{sarama.ErrOutOfBrokers.Error(): 1, ErrZeroSchemaId.Error(): 2}
+	total := map[string]int{}
+	for deadline := time.After(time.Second); !reflect.DeepEqual(total, expected); {
+		select {
+		case counts := <-summaries:
+			for cause, n := range counts {
+				total[cause] += n
+			}
+		case <-deadline:
+			t.Fatalf("Expected summaries adding up to %v, got %v", expected, total)
+		}
+	}
+	avroConsumer.Close()
+	<-done
+	if n := atomic.LoadInt32(&reported); n != 3 {
+		t.Errorf("Expected every error to be passed to OnError as well, got %d", n)
+	}
+}
+
+func TestErrorSummary_Flush(t *testing.T) {
+	summary := newErrorSummary()
+	summary.add(errors.New("boom"))
+	summary.add(&DecodeError{Offset: 4, Err: errors.New("boom")})
+	counts, _ := summary.flush()
+	if !reflect.DeepEqual(counts, map[string]int{"boom": 2}) {
+		t.Errorf("Expected errors to be counted by cause, got %v", counts)
+	}
+	if counts, _ := summary.flush(); len(counts) != 0 {
+		t.Errorf("Expected an empty window after a flush, got %v", counts)
+	}
+}
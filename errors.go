@@ -2,10 +2,155 @@ package kafka
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
 )
 
+// ErrMissingDataCallback is returned when a consumer is created without an OnDataReceived callback
+var ErrMissingDataCallback = errors.New("consumer callbacks must set OnDataReceived")
+
+// ErrShortValue is returned when a value is too short to hold the schema registry framing
+var ErrShortValue = errors.New("value is shorter than the schema registry framing")
+
+// ErrInvalidMagicByte is returned when a value doesn't start with the magic byte 0 of the schema registry framing
+var ErrInvalidMagicByte = errors.New("value doesn't start with the schema registry magic byte")
+
+// ErrZeroSchemaId is the cause of a DecodeError when a message is framed with schema id 0,
+// which the schema registry never assigns and usually means the producer didn't initialize the framing
+var ErrZeroSchemaId = errors.New("schema id 0 is never assigned by schema registry")
+
+// ErrUnknownFingerprint is the cause of a DecodeError when no codec is registered for the schema fingerprint
+// of a value in single object encoding
+var ErrUnknownFingerprint = errors.New("no codec registered for the schema fingerprint")
+
+// ErrIdleTimeout is returned by ConsumeN when no message arrived within the consumer's IdleTimeout
+var ErrIdleTimeout = errors.New("no message arrived within the idle timeout")
+
+// ErrMaxDepthExceeded is the cause of a DecodeError when a value is nested deeper than the consumer's MaxDepth
+var ErrMaxDepthExceeded = errors.New("value is nested deeper than the maximum depth")
+
+// ErrSchemaNotAllowed is the cause of a DecodeError when the schema id of a message isn't in the consumer's AllowedSchemaIDs
+var ErrSchemaNotAllowed = errors.New("schema id is not allowed")
+
+// ErrSubjectNotAllowed is the cause of a DecodeError when the schema of a message isn't registered under any of
+// the consumer's AllowedSubjects
+var ErrSubjectNotAllowed = errors.New("schema isn't registered under an allowed subject")
+
+// ErrUnnamedSchema is returned by RecordNameStrategy for schemas without a name, e.g. a union or a primitive type
+var ErrUnnamedSchema = errors.New("schema has no record name to derive the subject from")
+
+// ErrOffsetResetUnsupported is returned by ResetToEarliest and ResetToLatest for consumers without a consumer group,
+// e.g. from NewAvroConsumerWithSarama
+var ErrOffsetResetUnsupported = errors.New("consumer can't reset the offsets of a consumer group")
+
+// ErrUnsupportedColumnType is the cause of a DecodeError when DecodeColumns can't turn a field into a column,
+// e.g. a nested record, or when the schema isn't a record
+var ErrUnsupportedColumnType = errors.New("field type is not supported in columns")
+
+// ErrMixedSchemas is the cause of a DecodeError when a batch passed to DecodeColumns mixes schema ids
+var ErrMixedSchemas = errors.New("batch mixes values of different schemas")
+
+// ErrBodyChecksum is the cause of a DecodeError when a snappy compressed body doesn't match its checksum
+var ErrBodyChecksum = errors.New("body doesn't match its checksum")
+
+// ErrTombstone is the cause of a DecodeError passed to the StreamProcessor's OnError for messages without a value,
+// there is no record to transform
+var ErrTombstone = errors.New("message is a tombstone")
+
+// ErrDecompressedTooLarge is the cause of a DecodeError when a body decompresses to more than the consumer's
+// MaxDecompressedSize
+var ErrDecompressedTooLarge = errors.New("body decompresses to more than the maximum size")
+
+// ErrEmptyRecord is the cause of a DecodeError when DecodeAll decodes a record that takes no bytes, e.g. of a null
+// schema, and bytes remain that can never be consumed
+var ErrEmptyRecord = errors.New("record takes no bytes but the value has trailing bytes")
+
+// ErrSimplifiedValueChanged is returned by ReEncode when the Value simplified by EnumsAsStrings or NullableUnions was
+// changed, the simplified form can't be converted back to avro
+var ErrSimplifiedValueChanged = errors.New("simplified value was changed and can't be re-encoded")
+
+// ErrInvalidInterval is returned by StartSubjectRefresher for an interval that isn't positive
+var ErrInvalidInterval = errors.New("refresh interval must be > 0")
+
+// ErrUnsupportedSchemaType is returned for registered schemas of another type than avro, e.g. JSON or PROTOBUF
+type ErrUnsupportedSchemaType struct {
+	SchemaType string
+}
+
+func (e *ErrUnsupportedSchemaType) Error() string {
+	return fmt.Sprintf("unsupported schema type %s", e.SchemaType)
+}
+
+// ErrUnsupportedBodyCompression is the cause of a DecodeError when the consumer's BodyCompression is unknown
+type ErrUnsupportedBodyCompression struct {
+	Compression BodyCompression
+}
+
+func (e *ErrUnsupportedBodyCompression) Error() string {
+	return fmt.Sprintf("unsupported body compression %q", string(e.Compression))
+}
+
+// DecodeError holds the details of a message that could not be decoded
+type DecodeError struct {
+	SchemaId  int
+	Topic     string
+	Partition int32
+	Offset    int64
+	// Field is a best effort path to the field that failed to decode, e.g. "order.items[2].price"
+	Field string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("cannot decode message %s/%d@%d with schema %d, field %s: %s", e.Topic, e.Partition, e.Offset, e.SchemaId, e.Field, e.Err)
+	}
+	return fmt.Sprintf("cannot decode message %s/%d@%d with schema %d: %s", e.Topic, e.Partition, e.Offset, e.SchemaId, e.Err)
+}
+
+// fatalErrors are permanent kafka errors, consuming again won't succeed until the configuration is fixed.
+// Unknown topics or partitions are not, they are reported while a topic is created or its leader moves
+var fatalErrors = map[sarama.KError]bool{
+	sarama.ErrInvalidTopic:                       true,
+	sarama.ErrTopicAuthorizationFailed:           true,
+	sarama.ErrGroupAuthorizationFailed:           true,
+	sarama.ErrClusterAuthorizationFailed:         true,
+	sarama.ErrSASLAuthenticationFailed:           true,
+	sarama.ErrUnsupportedSASLMechanism:           true,
+	sarama.ErrIllegalSASLState:                   true,
+	sarama.ErrUnsupportedVersion:                 true,
+	sarama.ErrInconsistentGroupProtocol:          true,
+	sarama.ErrInvalidSessionTimeout:              true,
+	sarama.ErrTransactionalIDAuthorizationFailed: true,
+}
+
+// IsFatal reports whether a consumer error is permanent, e.g. an authorization failure or an invalid topic name
+func IsFatal(err error) bool {
+	switch e := err.(type) {
+	case *cluster.Error:
+		// the kafka error sarama-cluster wraps isn't exported, it is matched by its message
+		return isFatalMessage(e.Error())
+	case *sarama.ConsumerError:
+		err = e.Err
+	}
+	kerr, ok := err.(sarama.KError)
+	return ok && fatalErrors[kerr]
+}
+
+// isFatalMessage reports whether msg is the message of one of the fatalErrors
+func isFatalMessage(msg string) bool {
+	for kerr := range fatalErrors {
+		if kerr.Error() == msg {
+			return true
+		}
+	}
+	return false
+}
+
 // Error holds more detailed information about errors coming back from schema registry
 type Error struct {
 	ErrorCode int    `json:"error_code"`
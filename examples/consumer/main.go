@@ -27,5 +27,7 @@ func main() {
 	if err != nil {
 		fmt.Println(err)
 	}
-	consumer.Consume()
+	if err := consumer.Consume(); err != nil {
+		fmt.Println("Consumer stopped", err)
+	}
 }
@@ -0,0 +1,88 @@
+package kafka
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// expvarPrefix prefixes the names of the expvar maps of consumers
+const expvarPrefix = "go-kafka-avro"
+
+var (
+	// expvarLock serializes publishing maps, expvar panics when a name is published twice
+	expvarLock sync.Mutex
+	// expvarClientsLock guards expvarClients on its own, registry_fetches is read while expvar holds its locks
+	expvarClientsLock sync.Mutex
+	// expvarClients are the distinct registry clients of the consumers sharing a map, registry_fetches is their sum
+	expvarClients = make(map[string][]*CachedSchemaRegistryClient)
+)
+
+// consumerVars are the expvar counters of a consumer, see PublishExpvar
+type consumerVars struct {
+	messages     *expvar.Int
+	bytes        *expvar.Int
+	decodeErrors *expvar.Int
+}
+
+// PublishExpvar publishes the counters of the consumer in an expvar.Map named "go-kafka-avro.<group>", served on
+// /debug/vars by expvar's handler: the messages and bytes decoded, decode_errors and registry_fetches of schemas
+// that weren't cached yet. Consumers of the same group share the counters, registry_fetches sums the fetches of
+// their registry clients. Nothing is published unless it is called, call it before Consume
+func (ac *avroConsumer) PublishExpvar() *expvar.Map {
+	name := expvarPrefix
+	if ac.groupId != "" {
+		name += "." + ac.groupId
+	}
+	expvarLock.Lock()
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(name)
+		vars.Set("registry_fetches", expvar.Func(func() interface{} { return registryFetches(name) }))
+	}
+	ac.vars = &consumerVars{
+		messages:     expvarInt(vars, "messages"),
+		bytes:        expvarInt(vars, "bytes"),
+		decodeErrors: expvarInt(vars, "decode_errors"),
+	}
+	expvarLock.Unlock()
+	expvarClientsLock.Lock()
+	defer expvarClientsLock.Unlock()
+	for _, client := range expvarClients[name] {
+		if client == ac.SchemaRegistryClient {
+			return vars
+		}
+	}
+	expvarClients[name] = append(expvarClients[name], ac.SchemaRegistryClient)
+	return vars
+}
+
+// registryFetches sums the schemas fetched by the registry clients of the consumers publishing the map
+func registryFetches(name string) int64 {
+	expvarClientsLock.Lock()
+	defer expvarClientsLock.Unlock()
+	var fetches int64
+	for _, client := range expvarClients[name] {
+		fetches += atomic.LoadInt64(&client.fetches)
+	}
+	return fetches
+}
+
+// expvarInt returns the counter of the map with the key, which is added when missing
+func expvarInt(vars *expvar.Map, key string) *expvar.Int {
+	if counter, ok := vars.Get(key).(*expvar.Int); ok {
+		return counter
+	}
+	counter := new(expvar.Int)
+	vars.Set(key, counter)
+	return counter
+}
+
+// count records a message decoded by ProcessAvroMsg
+func (vars *consumerVars) count(value []byte, err error) {
+	vars.messages.Add(1)
+	vars.bytes.Add(int64(len(value)))
+	if err != nil {
+		vars.decodeErrors.Add(1)
+	}
+}
@@ -0,0 +1,111 @@
+package kafka
+
+import (
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestAvroConsumer_PublishExpvar(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.groupId = "expvar-test"
+	vars := avroConsumer.PublishExpvar()
+	if expvar.Get("go-kafka-avro.expvar-test") != vars {
+		t.Fatalf("Expected the map to be published under the consumer group")
+	}
+	counter := func(key string) int64 {
+		switch v := vars.Get(key).(type) {
+		case *expvar.Int:
+			return v.Value()
+		case expvar.Func:
+			return v.Value().(int64)
+		}
+		t.Fatalf("Missing counter %s", key)
+		return 0
+	}
+	// the map outlives the test when it runs several times
+	messages, bytes, decodeErrors := counter("messages"), counter("bytes"), counter("decode_errors")
+	fetches := counter("registry_fetches")
+	value := getTestAvroMsg(t, schemaRegistryTestObject.Codec)
+	for i := 0; i < 2; i++ {
+		if _, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: value}); err != nil {
+			t.Errorf("Error process avro msg: %v", err)
+		}
+	}
+	if _, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: []byte{0, 0}}); err == nil {
+		t.Errorf("Expected a decode error")
+	}
+	if n := counter("messages") - messages; n != 3 {
+		t.Errorf("Expected 3 messages, got %d", n)
+	}
+	if n := counter("bytes") - bytes; n != int64(2*len(value)+2) {
+		t.Errorf("Expected %d bytes, got %d", 2*len(value)+2, n)
+	}
+	if n := counter("decode_errors") - decodeErrors; n != 1 {
+		t.Errorf("Expected 1 decode error, got %d", n)
+	}
+	if n := counter("registry_fetches") - fetches; n != 1 {
+		t.Errorf("Expected the schema to be fetched once, got %d", n)
+	}
+	other := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	other.groupId = "expvar-test"
+	if other.PublishExpvar() != vars {
+		t.Errorf("Expected consumers of the same group to share the map")
+	}
+	third := newAvroConsumer(nil, NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL}), ConsumerCallbacks{}, nil)
+	third.groupId = "expvar-test"
+	third.PublishExpvar()
+	if _, err := third.ProcessAvroMsg(&sarama.ConsumerMessage{Value: value}); err != nil {
+		t.Errorf("Error process avro msg: %v", err)
+	}
+	if n := counter("registry_fetches") - fetches; n != 2 {
+		t.Errorf("Expected the fetches of both registry clients to be summed, got %d", n)
+	}
+}
+
+func TestAvroConsumer_PublishExpvarConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			avroConsumer := newAvroConsumer(nil, NewCachedSchemaRegistryClient([]string{"http://localhost"}), ConsumerCallbacks{}, nil)
+			avroConsumer.groupId = "expvar-concurrent-test"
+			avroConsumer.PublishExpvar()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAvroConsumer_PublishExpvarWhileServing(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				expvar.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/vars", nil))
+			}
+		}()
+		for i := 0; i < 200; i++ {
+			avroConsumer := newAvroConsumer(nil, NewCachedSchemaRegistryClient([]string{"http://localhost"}), ConsumerCallbacks{}, nil)
+			avroConsumer.groupId = fmt.Sprintf("expvar-serving-test-%d", i)
+			avroConsumer.PublishExpvar()
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected publishing and serving the vars not to deadlock")
+	}
+}
@@ -0,0 +1,207 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/linkedin/goavro"
+)
+
+// singleObjectMarker prefixes values in avro's single object encoding, followed by the
+// little-endian CRC-64-AVRO fingerprint of the writer schema
+var singleObjectMarker = []byte{0xc3, 0x01}
+
+const singleObjectHeaderSize = 10
+
+// emptyFingerprint is the CRC-64-AVRO fingerprint of no data
+const emptyFingerprint uint64 = 0xc15d213aa4d7a795
+
+var fingerprintTable = newFingerprintTable()
+
+func newFingerprintTable() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (emptyFingerprint & -(fp & 1))
+		}
+		table[i] = fp
+	}
+	return table
+}
+
+// Fingerprint returns the CRC-64-AVRO (Rabin) fingerprint of the parsing canonical form of the codec's schema,
+// as used by avro's single object encoding
+func Fingerprint(codec *goavro.Codec) (uint64, error) {
+	canonical, err := canonicalForm(codec.Schema())
+	if err != nil {
+		return 0, err
+	}
+	return rabinFingerprint([]byte(canonical)), nil
+}
+
+func rabinFingerprint(data []byte) uint64 {
+	fp := emptyFingerprint
+	for _, b := range data {
+		fp = (fp >> 8) ^ fingerprintTable[byte(fp)^b]
+	}
+	return fp
+}
+
+// hasSingleObjectMarker reports whether the value is framed with avro's single object encoding
+func hasSingleObjectMarker(value []byte) bool {
+	return len(value) >= singleObjectHeaderSize && bytes.HasPrefix(value, singleObjectMarker)
+}
+
+// avroBody returns the binary avro data of a value after its framing
+func avroBody(value []byte) []byte {
+	if hasSingleObjectMarker(value) {
+		return value[singleObjectHeaderSize:]
+	}
+	return value[5:]
+}
+
+// canonicalForm returns the parsing canonical form of a schema: full names, no attributes
+// that don't affect the binary encoding, and a fixed key order
+func canonicalForm(schema string) (string, error) {
+	var spec interface{}
+	decoder := json.NewDecoder(strings.NewReader(schema))
+	decoder.UseNumber()
+	if err := decoder.Decode(&spec); err != nil {
+		// unadorned primitive type names are valid schemas as well
+		spec = schema
+	}
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, spec, "", make(map[string]bool)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, spec interface{}, namespace string, defined map[string]bool) error {
+	switch v := spec.(type) {
+	case string:
+		switch v {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			writeCanonicalString(buf, v)
+		default:
+			writeCanonicalString(buf, fullName(v, namespace))
+		}
+		return nil
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, branch := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, branch, namespace, defined); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	case map[string]interface{}:
+		return writeCanonicalComplexType(buf, v, namespace, defined)
+	}
+	return fmt.Errorf("unsupported schema definition %v", spec)
+}
+
+func writeCanonicalComplexType(buf *bytes.Buffer, spec map[string]interface{}, namespace string, defined map[string]bool) error {
+	typeName, ok := spec["type"].(string)
+	if !ok {
+		return writeCanonical(buf, spec["type"], namespace, defined)
+	}
+	switch typeName {
+	case "record", "error", "enum", "fixed":
+		name, _ := spec["name"].(string)
+		if ns, ok := spec["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		name = fullName(name, namespace)
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			namespace = name[:i]
+		}
+		if defined[name] {
+			writeCanonicalString(buf, name)
+			return nil
+		}
+		defined[name] = true
+		buf.WriteString(`{"name":`)
+		writeCanonicalString(buf, name)
+		buf.WriteString(`,"type":`)
+		writeCanonicalString(buf, typeName)
+	case "array", "map":
+		buf.WriteString(`{"type":`)
+		writeCanonicalString(buf, typeName)
+	default:
+		// primitive type with attributes or a reference to a named type
+		return writeCanonical(buf, typeName, namespace, defined)
+	}
+	switch typeName {
+	case "record", "error":
+		buf.WriteString(`,"fields":[`)
+		fields, _ := spec["fields"].([]interface{})
+		for i, f := range fields {
+			field, _ := f.(map[string]interface{})
+			fieldName, _ := field["name"].(string)
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(`{"name":`)
+			writeCanonicalString(buf, fieldName)
+			buf.WriteString(`,"type":`)
+			if err := writeCanonical(buf, field["type"], namespace, defined); err != nil {
+				return fmt.Errorf("field %q: %s", fieldName, err)
+			}
+			buf.WriteByte('}')
+		}
+		buf.WriteByte(']')
+	case "enum":
+		buf.WriteString(`,"symbols":[`)
+		symbols, _ := spec["symbols"].([]interface{})
+		for i, symbol := range symbols {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			s, _ := symbol.(string)
+			writeCanonicalString(buf, s)
+		}
+		buf.WriteByte(']')
+	case "fixed":
+		size, _ := spec["size"].(json.Number)
+		fmt.Fprintf(buf, `,"size":%s`, size)
+	case "array":
+		buf.WriteString(`,"items":`)
+		if err := writeCanonical(buf, spec["items"], namespace, defined); err != nil {
+			return err
+		}
+	case "map":
+		buf.WriteString(`,"values":`)
+		if err := writeCanonical(buf, spec["values"], namespace, defined); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	quoted, _ := json.Marshal(s)
+	buf.Write(quoted)
+}
+
+// singleObjectFingerprint returns the writer schema fingerprint of a value in single object encoding
+func singleObjectFingerprint(value []byte) uint64 {
+	return binary.LittleEndian.Uint64(value[len(singleObjectMarker):singleObjectHeaderSize])
+}
+
+// encodeSingleObject frames a binary avro value in single object encoding
+func encodeSingleObject(fingerprint uint64, binaryValue []byte) []byte {
+	value := make([]byte, singleObjectHeaderSize, singleObjectHeaderSize+len(binaryValue))
+	copy(value, singleObjectMarker)
+	binary.LittleEndian.PutUint64(value[len(singleObjectMarker):], fingerprint)
+	return append(value, binaryValue...)
+}
@@ -0,0 +1,117 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/linkedin/goavro"
+)
+
+func TestCanonicalForm(t *testing.T) {
+	tests := []struct {
+		schema    string
+		canonical string
+	}{
+		{`"int"`, `"int"`},
+		{`{"type": "long", "logicalType": "timestamp-millis"}`, `"long"`},
+		{`{"type": "record", "name": "test", "namespace": "test.ns", "doc": "test record",
+			"fields": [{"name": "val", "type": "int", "default": 0}, {"name": "next", "type": ["null", "test"]}]}`,
+			`{"name":"test.ns.test","type":"record","fields":[{"name":"val","type":"int"},{"name":"next","type":["null","test.ns.test"]}]}`},
+		{`{"type": "map", "values": {"type": "fixed", "name": "md5", "size": 16}}`,
+			`{"type":"map","values":{"name":"md5","type":"fixed","size":16}}`},
+	}
+	for _, test := range tests {
+		canonical, err := canonicalForm(test.schema)
+		if err != nil {
+			t.Errorf("Error creating canonical form of %s: %v", test.schema, err)
+		}
+		if canonical != test.canonical {
+			t.Errorf("Expected canonical form %s, got %s", test.canonical, canonical)
+		}
+	}
+}
+
+func TestRabinFingerprint(t *testing.T) {
+	// fingerprints from the avro specification test suite
+	tests := map[string]uint64{
+		`"null"`: 7195948357588979594,
+		`"int"`:  8247732601305521295,
+	}
+	for canonical, expected := range tests {
+		if fingerprint := rabinFingerprint([]byte(canonical)); fingerprint != expected {
+			t.Errorf("Expected fingerprint %d of %s, got %d", expected, canonical, fingerprint)
+		}
+	}
+}
+
+func TestAvroConsumer_SingleObjectEncoding(t *testing.T) {
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "test", "fields": [{"name": "val", "type": "int"}]}`)
+	if err != nil {
+		t.Fatalf("Could not create codec %v", err)
+	}
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{"http://localhost"})
+	fingerprint, err := schemaRegistryMock.RegisterCodec(codec)
+	if err != nil {
+		t.Fatalf("Error registering codec: %v", err)
+	}
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.SingleObjectEncoding = true
+	binaryValue, err := codec.BinaryFromNative(nil, map[string]interface{}{"val": 1})
+	if err != nil {
+		t.Fatalf("Error get binary from native: %v", err)
+	}
+	value := make([]byte, singleObjectHeaderSize)
+	copy(value, singleObjectMarker)
+	binary.LittleEndian.PutUint64(value[2:], fingerprint)
+	msg, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: append(value, binaryValue...)})
+	if err != nil {
+		t.Errorf("Error process avro msg: %v", err)
+	}
+	if msg.Value != `{"val":1}` || msg.Fingerprint != fingerprint {
+		t.Errorf("Wrong data: %v", msg)
+	}
+	binary.LittleEndian.PutUint64(value[2:], fingerprint+1)
+	_, err = avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: append(value, binaryValue...)})
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrUnknownFingerprint {
+		t.Errorf("Expected ErrUnknownFingerprint, got %v", err)
+	}
+}
+
+func TestAvroConsumer_SingleObjectEncodingAllowedSchemaIDs(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	defer schemaRegistryTestObject.MockServer.Close()
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	codec := schemaRegistryTestObject.Codec
+	fingerprint, err := Fingerprint(codec)
+	if err != nil {
+		t.Fatalf("Error computing fingerprint: %v", err)
+	}
+	avroConsumer := newAvroConsumer(nil, schemaRegistryMock, ConsumerCallbacks{}, nil)
+	avroConsumer.SingleObjectEncoding = true
+	avroConsumer.AllowedSchemaIDs = map[int]bool{1: true}
+	value := encodeSingleObject(fingerprint, []byte{2})
+	// registered by hand, the schema id is unknown
+	schemaRegistryMock.RegisterCodec(codec)
+	_, err = avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: value})
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrSchemaNotAllowed {
+		t.Errorf("Expected ErrSchemaNotAllowed for a schema without id, got %v", err)
+	}
+	if _, err := schemaRegistryMock.GetSchema(1); err != nil {
+		t.Fatalf("Error getting schema: %v", err)
+	}
+	if msg, err := avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: value}); err != nil || msg.Value != testData {
+		t.Errorf("Expected the value of an allowed schema to be decoded, got %v", err)
+	}
+	avroConsumer.AllowedSchemaIDs = map[int]bool{2: true}
+	_, err = avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: value})
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrSchemaNotAllowed {
+		t.Errorf("Expected ErrSchemaNotAllowed, got %v", err)
+	}
+	avroConsumer.AllowedSchemaIDs = nil
+	avroConsumer.AllowedSubjects = []string{"other"}
+	_, err = avroConsumer.ProcessAvroMsg(&sarama.ConsumerMessage{Value: value})
+	if decodeErr, ok := err.(*DecodeError); !ok || decodeErr.Err != ErrSubjectNotAllowed {
+		t.Errorf("Expected ErrSubjectNotAllowed, got %v", err)
+	}
+}
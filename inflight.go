@@ -0,0 +1,60 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// offsetTracker keeps the messages that are processed concurrently in the order they were consumed,
+// so offsets are only marked once all earlier messages of the partition are done
+type offsetTracker struct {
+	partitions map[topicPartition][]*trackedMessage
+	lock       sync.Mutex
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+type trackedMessage struct {
+	msg  *sarama.ConsumerMessage
+	done bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[topicPartition][]*trackedMessage)}
+}
+
+// add registers a message before its processing starts
+func (t *offsetTracker) add(m *sarama.ConsumerMessage) *trackedMessage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tp := topicPartition{m.Topic, m.Partition}
+	tracked := &trackedMessage{msg: m}
+	t.partitions[tp] = append(t.partitions[tp], tracked)
+	return tracked
+}
+
+// done flags the message as processed and marks the last message of the partition that has no pending predecessor
+func (t *offsetTracker) done(tracked *trackedMessage, mark func(m *sarama.ConsumerMessage)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tracked.done = true
+	tp := topicPartition{tracked.msg.Topic, tracked.msg.Partition}
+	pending := t.partitions[tp]
+	var last *sarama.ConsumerMessage
+	for len(pending) > 0 && pending[0].done {
+		last = pending[0].msg
+		pending = pending[1:]
+	}
+	if len(pending) == 0 {
+		delete(t.partitions, tp)
+	} else {
+		t.partitions[tp] = pending
+	}
+	if last != nil {
+		mark(last)
+	}
+}
@@ -0,0 +1,11 @@
+package kafka
+
+import (
+	"io/ioutil"
+	"log"
+
+	"github.com/Shopify/sarama"
+)
+
+// Logger receives warnings of the package, it discards them by default just like sarama.Logger
+var Logger sarama.StdLogger = log.New(ioutil.Discard, "[go-kafka-avro] ", log.LstdFlags)
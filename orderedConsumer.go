@@ -0,0 +1,179 @@
+package kafka
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// PartitionOffset is a partition read from Offset on, which may be sarama.OffsetOldest or sarama.OffsetNewest
+type PartitionOffset struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+type orderedPartition struct {
+	consumer sarama.PartitionConsumer
+	// next is the offset of the next message to read, the partition is exhausted once it reaches end
+	next int64
+	end  int64
+	head *sarama.ConsumerMessage
+}
+
+// defaultOrderedIdleTimeout is how long a partition may go without a message when IdleTimeout isn't set
+const defaultOrderedIdleTimeout = time.Second
+
+type avroOrderedConsumer struct {
+	SchemaRegistryClient *CachedSchemaRegistryClient
+	client               io.Closer
+	consumer             sarama.Consumer
+	partitions           []*orderedPartition
+	decoder              *avroConsumer
+
+	// IdleTimeout is how long Next waits for the next message of a partition before it considers the partition read
+	// up to its high water mark, e.g. when its last offsets are transaction markers or were compacted away.
+	// Defaults to a second
+	IdleTimeout time.Duration
+}
+
+// NewOrderedConsumer returns a consumer that reads a fixed set of partitions up to their high water marks at creation,
+// without any consumer group coordination. Next merges the partitions deterministically: every partition is read in
+// offset order, and of the next messages of all partitions the one with the oldest timestamp is returned first,
+// ties go to the partition passed in first. The order only depends on the data, which makes tests of ordering
+// sensitive logic reproducible
+func NewOrderedConsumer(kafkaServers []string, schemaRegistryServers []string,
+	partitions []PartitionOffset) (*avroOrderedConsumer, error) {
+	config := sarama.NewConfig()
+	// Next orders messages by their timestamps, which require kafka 0.10+
+	config.Version = sarama.V0_10_0_0
+	config.Consumer.Return.Errors = true
+	client, err := sarama.NewClient(kafkaServers, config)
+	if err != nil {
+		return nil, err
+	}
+	starts := make([]PartitionOffset, len(partitions))
+	ends := make([]int64, len(partitions))
+	for i, partition := range partitions {
+		if ends[i], err = client.GetOffset(partition.Topic, partition.Partition, sarama.OffsetNewest); err != nil {
+			client.Close()
+			return nil, err
+		}
+		starts[i] = partition
+		switch partition.Offset {
+		case sarama.OffsetNewest:
+			starts[i].Offset = ends[i]
+		case sarama.OffsetOldest:
+			if starts[i].Offset, err = client.GetOffset(partition.Topic, partition.Partition, sarama.OffsetOldest); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	schemaRegistryClient := NewCachedSchemaRegistryClient(schemaRegistryServers)
+	oc, err := newAvroOrderedConsumer(consumer, schemaRegistryClient, starts, ends)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	oc.client = client
+	return oc, nil
+}
+
+func newAvroOrderedConsumer(consumer sarama.Consumer, schemaRegistryClient *CachedSchemaRegistryClient,
+	starts []PartitionOffset, ends []int64) (*avroOrderedConsumer, error) {
+	oc := &avroOrderedConsumer{
+		SchemaRegistryClient: schemaRegistryClient,
+		consumer:             consumer,
+		decoder:              newAvroConsumer(nil, schemaRegistryClient, ConsumerCallbacks{}, nil),
+	}
+	for i, start := range starts {
+		partitionConsumer, err := consumer.ConsumePartition(start.Topic, start.Partition, start.Offset)
+		if err != nil {
+			oc.Close()
+			return nil, err
+		}
+		oc.partitions = append(oc.partitions, &orderedPartition{consumer: partitionConsumer, next: start.Offset, end: ends[i]})
+	}
+	return oc, nil
+}
+
+// Next blocks until the next message in the merged order is read and decoded or the context is done,
+// io.EOF is returned once every partition is read up to its high water mark or the consumer is closed
+func (oc *avroOrderedConsumer) Next(ctx context.Context) (Message, error) {
+	idle := oc.IdleTimeout
+	if idle <= 0 {
+		idle = defaultOrderedIdleTimeout
+	}
+	var next *orderedPartition
+	for _, partition := range oc.partitions {
+		if partition.head == nil && partition.next < partition.end {
+			if err := partition.read(ctx, idle); err != nil {
+				return Message{}, err
+			}
+		}
+		if partition.head != nil && (next == nil || partition.head.Timestamp.Before(next.head.Timestamp)) {
+			next = partition
+		}
+	}
+	if next == nil {
+		return Message{}, io.EOF
+	}
+	m := next.head
+	next.head, next.next = nil, m.Offset+1
+	return oc.decoder.ProcessAvroMsg(m)
+}
+
+// read waits for the next message of the partition. The partition is exhausted when the message is past its high water
+// mark, or when none arrives for idle as offsets up to the high water mark may hold no message at all
+func (p *orderedPartition) read(ctx context.Context, idle time.Duration) error {
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	select {
+	case m, ok := <-p.consumer.Messages():
+		if !ok {
+			return io.EOF
+		}
+		if m.Offset >= p.end {
+			p.next = p.end
+			return nil
+		}
+		p.head = m
+		return nil
+	case <-timer.C:
+		p.next = p.end
+		return nil
+	case err, ok := <-p.consumer.Errors():
+		if !ok {
+			return io.EOF
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (oc *avroOrderedConsumer) Close() error {
+	var err error
+	for _, partition := range oc.partitions {
+		if e := partition.consumer.Close(); e != nil {
+			err = e
+		}
+	}
+	if e := oc.consumer.Close(); e != nil {
+		err = e
+	}
+	if oc.client != nil {
+		if e := oc.client.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
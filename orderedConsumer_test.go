@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func TestAvroOrderedConsumer_Next(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	value := getTestAvroMsg(t, schemaRegistryTestObject.Codec)
+	consumerMock := mocks.NewConsumer(t, nil)
+	base := time.Unix(1600000000, 0)
+	for partition, seconds := range [][]int{{1, 3}, {2, 3}} {
+		partitionConsumer := consumerMock.ExpectConsumePartition("test", int32(partition), 0)
+		for _, s := range seconds {
+			partitionConsumer.YieldMessage(&sarama.ConsumerMessage{Value: value, Timestamp: base.Add(time.Duration(s) * time.Second)})
+		}
+	}
+	starts := []PartitionOffset{{Topic: "test", Partition: 0}, {Topic: "test", Partition: 1}}
+	orderedConsumer, err := newAvroOrderedConsumer(consumerMock, schemaRegistryMock, starts, []int64{3, 3})
+	if err != nil {
+		t.Fatalf("Error creating ordered consumer: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	expected := []struct {
+		partition int32
+		offset    int64
+	}{{0, 1}, {1, 1}, {0, 2}, {1, 2}}
+	for _, e := range expected {
+		msg, err := orderedConsumer.Next(ctx)
+		if err != nil {
+			t.Fatalf("Error reading msg: %v", err)
+		}
+		if msg.Partition != e.partition || msg.Offset != e.offset || msg.Value != testData {
+			t.Errorf("Expected partition %d offset %d, got partition %d offset %d", e.partition, e.offset, msg.Partition, msg.Offset)
+		}
+	}
+	if _, err := orderedConsumer.Next(ctx); err != io.EOF {
+		t.Errorf("Expected io.EOF once the partitions are read up to their high water marks, got %v", err)
+	}
+	if err := orderedConsumer.Close(); err != nil {
+		t.Errorf("Error closing ordered consumer: %v", err)
+	}
+}
+
+func TestAvroOrderedConsumer_NextGaps(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	value := getTestAvroMsg(t, schemaRegistryTestObject.Codec)
+	consumerMock := mocks.NewConsumer(t, nil)
+	// the last offset before the high water mark holds no message, e.g. a transaction marker
+	consumerMock.ExpectConsumePartition("test", 0, 0).YieldMessage(&sarama.ConsumerMessage{Value: value})
+	// a message produced after the consumer was created is past the high water mark
+	consumerMock.ExpectConsumePartition("test", 1, 0).YieldMessage(&sarama.ConsumerMessage{Value: value})
+	starts := []PartitionOffset{{Topic: "test", Partition: 0}, {Topic: "test", Partition: 1}}
+	orderedConsumer, err := newAvroOrderedConsumer(consumerMock, schemaRegistryMock, starts, []int64{3, 1})
+	if err != nil {
+		t.Fatalf("Error creating ordered consumer: %v", err)
+	}
+	defer orderedConsumer.Close()
+	orderedConsumer.IdleTimeout = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if msg, err := orderedConsumer.Next(ctx); err != nil || msg.Partition != 0 {
+		t.Fatalf("Expected the message of partition 0, got partition %d and error %v", msg.Partition, err)
+	}
+	if _, err := orderedConsumer.Next(ctx); err != io.EOF {
+		t.Errorf("Expected io.EOF once no message arrives before the high water marks, got %v", err)
+	}
+}
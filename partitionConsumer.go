@@ -0,0 +1,76 @@
+package kafka
+
+import (
+	"context"
+	"io"
+
+	"github.com/Shopify/sarama"
+)
+
+type avroPartitionConsumer struct {
+	SchemaRegistryClient *CachedSchemaRegistryClient
+	consumer             sarama.Consumer
+	partitionConsumer    sarama.PartitionConsumer
+	decoder              *avroConsumer
+}
+
+// NewPartitionConsumer returns a consumer that reads a single partition from the given offset without any consumer group
+// coordination. Messages are pulled one at a time with Next, which gives test harnesses full control over what is read
+func NewPartitionConsumer(kafkaServers []string, schemaRegistryServers []string,
+	topic string, partition int32, offset int64) (*avroPartitionConsumer, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+	consumer, err := sarama.NewConsumer(kafkaServers, config)
+	if err != nil {
+		return nil, err
+	}
+	schemaRegistryClient := NewCachedSchemaRegistryClient(schemaRegistryServers)
+	return newAvroPartitionConsumer(consumer, schemaRegistryClient, topic, partition, offset)
+}
+
+func newAvroPartitionConsumer(consumer sarama.Consumer, schemaRegistryClient *CachedSchemaRegistryClient,
+	topic string, partition int32, offset int64) (*avroPartitionConsumer, error) {
+	partitionConsumer, err := consumer.ConsumePartition(topic, partition, offset)
+	if err != nil {
+		consumer.Close()
+		return nil, err
+	}
+	return &avroPartitionConsumer{
+		SchemaRegistryClient: schemaRegistryClient,
+		consumer:             consumer,
+		partitionConsumer:    partitionConsumer,
+		decoder:              newAvroConsumer(nil, schemaRegistryClient, ConsumerCallbacks{}, nil),
+	}, nil
+}
+
+// Next blocks until the next message of the partition is read and decoded or the context is done,
+// io.EOF is returned once the consumer is closed
+func (pc *avroPartitionConsumer) Next(ctx context.Context) (Message, error) {
+	select {
+	case m, ok := <-pc.partitionConsumer.Messages():
+		if !ok {
+			return Message{}, io.EOF
+		}
+		return pc.decoder.ProcessAvroMsg(m)
+	case err, ok := <-pc.partitionConsumer.Errors():
+		if !ok {
+			return Message{}, io.EOF
+		}
+		return Message{}, err
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// HighWaterMarkOffset returns the offset of the next message that will be produced to the partition
+func (pc *avroPartitionConsumer) HighWaterMarkOffset() int64 {
+	return pc.partitionConsumer.HighWaterMarkOffset()
+}
+
+func (pc *avroPartitionConsumer) Close() error {
+	if err := pc.partitionConsumer.Close(); err != nil {
+		pc.consumer.Close()
+		return err
+	}
+	return pc.consumer.Close()
+}
@@ -0,0 +1,38 @@
+package kafka
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func TestAvroPartitionConsumer_Next(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	consumerMock := mocks.NewConsumer(t, nil)
+	consumerMock.ExpectConsumePartition("test", 3, sarama.OffsetOldest).
+		YieldMessage(&sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec)})
+	partitionConsumer, err := newAvroPartitionConsumer(consumerMock, schemaRegistryMock, "test", 3, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatalf("Error creating partition consumer: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msg, err := partitionConsumer.Next(ctx)
+	if err != nil {
+		t.Errorf("Error reading msg: %v", err)
+	}
+	if msg.Value != testData || msg.Partition != 3 {
+		t.Errorf("Wrong data")
+	}
+	if err := partitionConsumer.Close(); err != nil {
+		t.Errorf("Error closing partition consumer: %v", err)
+	}
+	if _, err := partitionConsumer.Next(ctx); err != io.EOF {
+		t.Errorf("Expected io.EOF after close, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package kafka
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// headers the retry ladder adds to republished messages
+const (
+	retryAttemptHeader   = "retry-attempt"
+	retryNotBeforeHeader = "retry-not-before"
+	retryTopicHeader     = "retry-original-topic"
+)
+
+// RetryStep is a topic failed messages are republished to, they are processed again once Delay passed
+type RetryStep struct {
+	Topic string
+	Delay time.Duration
+}
+
+// RetryLadder republishes messages whose callback failed to the next retry topic, e.g. retry-5s, retry-1m and retry-10m,
+// and finally to a dead letter topic. Set it as the RetryLadder of the consumer of the original topic and of
+// consumers of every retry topic, they hold back messages until their delay passed
+type RetryLadder struct {
+	Steps           []RetryStep
+	DeadLetterTopic string
+	// Backoff is how long the consumer waits before it republishes a message again when the last attempt failed,
+	// the message isn't marked until it was republished. Defaults to a second
+	Backoff  time.Duration
+	producer sarama.SyncProducer
+}
+
+// defaultRetryBackoff is the Backoff of ladders that don't set it
+const defaultRetryBackoff = time.Second
+
+// NewRetryLadder returns a ladder that republishes through its own producer, messages that failed on the last step
+// go to deadLetterTopic or are dropped when it is empty. Headers require kafka 0.11+
+func NewRetryLadder(kafkaServers []string, deadLetterTopic string, steps ...RetryStep) (*RetryLadder, error) {
+	config := newProducerConfig()
+	config.Version = sarama.V0_11_0_0
+	producer, err := sarama.NewSyncProducer(kafkaServers, config)
+	if err != nil {
+		return nil, err
+	}
+	return &RetryLadder{Steps: steps, DeadLetterTopic: deadLetterTopic, producer: producer}, nil
+}
+
+// Retry republishes the message to the step after the one it was consumed from
+func (rl *RetryLadder) Retry(m *sarama.ConsumerMessage) error {
+	attempt := 0
+	originalTopic := m.Topic
+	headers := make([]sarama.RecordHeader, 0, len(m.Headers)+3)
+	for _, header := range m.Headers {
+		switch string(header.Key) {
+		case retryAttemptHeader:
+			attempt, _ = strconv.Atoi(string(header.Value))
+		case retryTopicHeader:
+			originalTopic = string(header.Value)
+		case retryNotBeforeHeader:
+		default:
+			headers = append(headers, *header)
+		}
+	}
+	topic := rl.DeadLetterTopic
+	if attempt < len(rl.Steps) {
+		step := rl.Steps[attempt]
+		topic = step.Topic
+		notBefore := time.Now().Add(step.Delay).UnixNano() / int64(time.Millisecond)
+		headers = append(headers,
+			sarama.RecordHeader{Key: []byte(retryAttemptHeader), Value: []byte(strconv.Itoa(attempt + 1))},
+			sarama.RecordHeader{Key: []byte(retryNotBeforeHeader), Value: []byte(strconv.FormatInt(notBefore, 10))})
+	}
+	if topic == "" {
+		return nil
+	}
+	headers = append(headers, sarama.RecordHeader{Key: []byte(retryTopicHeader), Value: []byte(originalTopic)})
+	_, _, err := rl.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   topic,
+		Key:     sarama.ByteEncoder(m.Key),
+		Value:   sarama.ByteEncoder(m.Value),
+		Headers: headers,
+	})
+	return err
+}
+
+// delay returns how long the message has to wait before it is processed again
+func (rl *RetryLadder) delay(m *sarama.ConsumerMessage) time.Duration {
+	for _, header := range m.Headers {
+		if string(header.Key) == retryNotBeforeHeader {
+			notBefore, err := strconv.ParseInt(string(header.Value), 10, 64)
+			if err != nil {
+				return 0
+			}
+			return time.Until(time.Unix(0, notBefore*int64(time.Millisecond)))
+		}
+	}
+	return 0
+}
+
+func (rl *RetryLadder) backoff() time.Duration {
+	if rl.Backoff <= 0 {
+		return defaultRetryBackoff
+	}
+	return rl.Backoff
+}
+
+func (rl *RetryLadder) Close() error {
+	return rl.producer.Close()
+}
@@ -0,0 +1,195 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type capturingProducer struct {
+	sent []*sarama.ProducerMessage
+}
+
+func (p *capturingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent)), nil
+}
+
+func (p *capturingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.sent = append(p.sent, msgs...)
+	return nil
+}
+
+func (p *capturingProducer) Close() error { return nil }
+
+// failingProducer fails the first failures messages it sends
+type failingProducer struct {
+	capturingProducer
+	failures int
+}
+
+func (p *failingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if p.failures > 0 {
+		p.failures--
+		return 0, 0, errors.New("broker unavailable")
+	}
+	return p.capturingProducer.SendMessage(msg)
+}
+
+// consumed turns a produced message into the message a consumer of its topic receives
+func consumed(msg *sarama.ProducerMessage) *sarama.ConsumerMessage {
+	m := &sarama.ConsumerMessage{Topic: msg.Topic}
+	m.Key, _ = msg.Key.Encode()
+	m.Value, _ = msg.Value.Encode()
+	for i := range msg.Headers {
+		m.Headers = append(m.Headers, &msg.Headers[i])
+	}
+	return m
+}
+
+func TestRetryLadder_Retry(t *testing.T) {
+	producer := &capturingProducer{}
+	ladder := &RetryLadder{
+		Steps:           []RetryStep{{"retry-5s", 5 * time.Second}, {"retry-1m", time.Minute}},
+		DeadLetterTopic: "dlq",
+		producer:        producer,
+	}
+	m := &sarama.ConsumerMessage{Topic: "orders", Key: []byte("key"), Value: []byte("value")}
+	if delay := ladder.delay(m); delay != 0 {
+		t.Errorf("Expected no delay for the original message, got %s", delay)
+	}
+	for _, topic := range []string{"retry-5s", "retry-1m", "dlq"} {
+		if err := ladder.Retry(m); err != nil {
+			t.Fatalf("Error retrying message: %v", err)
+		}
+		sent := producer.sent[len(producer.sent)-1]
+		if sent.Topic != topic {
+			t.Errorf("Expected message to be republished to %s, got %s", topic, sent.Topic)
+		}
+		m = consumed(sent)
+	}
+	if delay := ladder.delay(consumed(producer.sent[0])); delay <= 0 || delay > 5*time.Second {
+		t.Errorf("Expected a delay of up to 5s, got %s", delay)
+	}
+	headers := map[string]string{}
+	for _, header := range m.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	if headers[retryTopicHeader] != "orders" || string(m.Value) != "value" {
+		t.Errorf("Expected the dead letter to keep the original topic and value, got %v", headers)
+	}
+}
+
+func TestAvroConsumer_RetryLadderFailure(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	for _, failures := range []int{2, 1000} {
+		producer := &failingProducer{failures: failures}
+		reported := make(chan error, 10)
+		callbacks := ConsumerCallbacks{
+			OnDataReceivedErr: func(msg Message) error { return errors.New("downstream unavailable") },
+			OnError: func(err error) {
+				select {
+				case reported <- err:
+				default:
+				}
+			},
+		}
+		mockConsumer := newMockClusterConsumer()
+		config := NewDefaultConfig()
+		config.Version = sarama.V0_11_0_0
+		avroConsumer := newAvroConsumer(mockConsumer, schemaRegistryMock, callbacks, config)
+		avroConsumer.RetryLadder = &RetryLadder{Steps: []RetryStep{{"retry-5s", 5 * time.Second}}, Backoff: time.Millisecond, producer: producer}
+		done := make(chan struct{})
+		go func() {
+			avroConsumer.Consume()
+			close(done)
+		}()
+		mockConsumer.messages <- &sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec), Topic: "test", Offset: 3}
+		// the callback error and two failed attempts to republish
+		for i := 0; i < 3; i++ {
+			<-reported
+		}
+		if failures == 2 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		avroConsumer.Close()
+		<-done
+		republished := len(producer.sent) == 1
+		if republished != (failures == 2) {
+			t.Errorf("%d failures: expected the message to be republished once the producer recovered, got %d", failures, len(producer.sent))
+		}
+		if marked := len(mockConsumer.marked) == 1; marked != republished {
+			t.Errorf("%d failures: expected the message to be marked only once it was republished, got %v", failures, mockConsumer.marked)
+		}
+	}
+}
+
+func TestAvroConsumer_RetryLadderRequiresHeaders(t *testing.T) {
+	avroConsumer := newAvroConsumer(newMockClusterConsumer(), nil, ConsumerCallbacks{}, NewDefaultConfig())
+	avroConsumer.RetryLadder = &RetryLadder{Steps: []RetryStep{{"retry-5s", 5 * time.Second}}, producer: &capturingProducer{}}
+	if _, ok := avroConsumer.Consume().(sarama.ConfigurationError); !ok {
+		t.Errorf("Expected a configuration error for a version without headers")
+	}
+}
+
+// TestRetryLadder_HeadersRoundTrip consumes a republished message from a broker with the consumer config
+// and checks the ladder still sees its attempt and delay
+func TestRetryLadder_HeadersRoundTrip(t *testing.T) {
+	producer := &capturingProducer{}
+	ladder := &RetryLadder{Steps: []RetryStep{{"retry-5s", 5 * time.Second}, {"retry-1m", time.Minute}}, producer: producer}
+	if err := ladder.Retry(&sarama.ConsumerMessage{Topic: "orders", Value: []byte("value")}); err != nil {
+		t.Fatalf("Error retrying message: %v", err)
+	}
+	sent := producer.sent[0]
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	fetch := &sarama.FetchResponse{Version: 4}
+	fetch.AddRecord("retry-5s", 0, nil, sent.Value, 0)
+	for i := range sent.Headers {
+		batch := fetch.GetBlock("retry-5s", 0).RecordsSet[0].RecordBatch
+		batch.Records[0].Headers = append(batch.Records[0].Headers, &sent.Headers[i])
+	}
+	fetch.SetLastOffsetDelta("retry-5s", 0, 0)
+	fetch.GetBlock("retry-5s", 0).HighWaterMarkOffset = 1
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("retry-5s", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetVersion(1).
+			SetOffset("retry-5s", 0, sarama.OffsetOldest, 0).
+			SetOffset("retry-5s", 0, sarama.OffsetNewest, 1),
+		"FetchRequest": sarama.NewMockWrapper(fetch),
+	})
+	config := NewDefaultConfig()
+	config.Version = sarama.V0_11_0_0
+	consumer, err := sarama.NewConsumer([]string{broker.Addr()}, &config.Config)
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	defer consumer.Close()
+	partitionConsumer, err := consumer.ConsumePartition("retry-5s", 0, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatalf("Error consuming partition: %v", err)
+	}
+	defer partitionConsumer.Close()
+	select {
+	case m := <-partitionConsumer.Messages():
+		if delay := ladder.delay(m); delay <= 0 || delay > 5*time.Second {
+			t.Errorf("Expected a delay of up to 5s, got %s", delay)
+		}
+		if err := ladder.Retry(m); err != nil {
+			t.Fatalf("Error retrying message: %v", err)
+		}
+		if topic := producer.sent[1].Topic; topic != "retry-1m" {
+			t.Errorf("Expected the second attempt to go to the next step, got %s", topic)
+		}
+	case err := <-partitionConsumer.Errors():
+		t.Fatalf("Error consuming: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a message")
+	}
+}
@@ -0,0 +1,113 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+)
+
+// saramaConsumer consumes all partitions of a topic with a plain sarama.Consumer, e.g. a mocks.Consumer.
+// There is no consumer group so marked offsets are only stashed in memory
+type saramaConsumer struct {
+	consumer      sarama.Consumer
+	partitions    []sarama.PartitionConsumer
+	messages      chan *sarama.ConsumerMessage
+	errors        chan error
+	notifications chan *cluster.Notification
+	offsets       *cluster.OffsetStash
+	closing       chan struct{}
+	closeOnce     sync.Once
+	wg            sync.WaitGroup
+}
+
+// NewAvroConsumerWithSarama returns a consumer that reads every partition of the topic with the passed in sarama.Consumer
+// and schema registry client. Together with sarama/mocks it allows testing decoding and dispatching without a broker
+func NewAvroConsumerWithSarama(consumer sarama.Consumer, schemaRegistryClient *CachedSchemaRegistryClient,
+	topic string, callbacks ConsumerCallbacks) (*avroConsumer, error) {
+	if err := callbacks.validate(); err != nil {
+		return nil, err
+	}
+	config := NewDefaultConfig()
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	source := &saramaConsumer{
+		consumer:      consumer,
+		messages:      make(chan *sarama.ConsumerMessage, config.ChannelBufferSize),
+		errors:        make(chan error, config.ChannelBufferSize),
+		notifications: make(chan *cluster.Notification),
+		offsets:       cluster.NewOffsetStash(),
+		closing:       make(chan struct{}),
+	}
+	for _, partition := range partitions {
+		partitionConsumer, err := consumer.ConsumePartition(topic, partition, config.Consumer.Offsets.Initial)
+		if err != nil {
+			source.Close()
+			return nil, err
+		}
+		source.partitions = append(source.partitions, partitionConsumer)
+		source.wg.Add(2)
+		go source.forwardMessages(partitionConsumer)
+		go source.forwardErrors(partitionConsumer)
+	}
+	return newAvroConsumer(source, schemaRegistryClient, callbacks, config), nil
+}
+
+func (c *saramaConsumer) forwardMessages(partitionConsumer sarama.PartitionConsumer) {
+	defer c.wg.Done()
+	for m := range partitionConsumer.Messages() {
+		select {
+		case c.messages <- m:
+		case <-c.closing:
+		}
+	}
+}
+
+func (c *saramaConsumer) forwardErrors(partitionConsumer sarama.PartitionConsumer) {
+	defer c.wg.Done()
+	for err := range partitionConsumer.Errors() {
+		select {
+		case c.errors <- err:
+		case <-c.closing:
+		}
+	}
+}
+
+func (c *saramaConsumer) Messages() <-chan *sarama.ConsumerMessage    { return c.messages }
+func (c *saramaConsumer) Errors() <-chan error                        { return c.errors }
+func (c *saramaConsumer) Notifications() <-chan *cluster.Notification { return c.notifications }
+
+func (c *saramaConsumer) MarkOffset(msg *sarama.ConsumerMessage, metadata string) {
+	c.offsets.MarkOffset(msg, metadata)
+}
+
+func (c *saramaConsumer) MarkPartitionOffset(topic string, partition int32, offset int64, metadata string) {
+	c.offsets.MarkPartitionOffset(topic, partition, offset, metadata)
+}
+
+// CommitOffsets is a no-op, without a consumer group there is nowhere to commit to
+func (c *saramaConsumer) CommitOffsets() error {
+	return nil
+}
+
+// Close stops consuming and closes the sarama.Consumer, calling it again is a no-op
+func (c *saramaConsumer) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		for _, partitionConsumer := range c.partitions {
+			if e := partitionConsumer.Close(); e != nil {
+				err = e
+			}
+		}
+		c.wg.Wait()
+		close(c.messages)
+		close(c.errors)
+		close(c.notifications)
+		if e := c.consumer.Close(); e != nil {
+			err = e
+		}
+	})
+	return
+}
@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func TestNewAvroConsumerWithSarama(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	testCases := []struct {
+		name    string
+		msg     *sarama.ConsumerMessage
+		value   string
+		headers map[string]string
+		err     bool
+	}{
+		{"avro", &sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec)}, testData, nil, false},
+		{"headers", &sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec),
+			Headers: []*sarama.RecordHeader{{Key: []byte("source"), Value: []byte("test")}}}, testData, map[string]string{"source": "test"}, false},
+		{"tombstone", &sarama.ConsumerMessage{Key: []byte("key")}, "", nil, false},
+		{"decode error", &sarama.ConsumerMessage{Value: []byte{0, 0, 0, 0, 1, 0x80}}, "", nil, true},
+	}
+	for _, testCase := range testCases {
+		received := make(chan Message, 1)
+		errs := make(chan error, 1)
+		callbacks := ConsumerCallbacks{
+			OnDataReceived: func(msg Message) { received <- msg },
+			OnError:        func(err error) { errs <- err },
+		}
+		consumerMock := mocks.NewConsumer(t, nil)
+		consumerMock.SetTopicMetadata(map[string][]int32{"test": {0}})
+		consumerMock.ExpectConsumePartition("test", 0, sarama.OffsetOldest).YieldMessage(testCase.msg)
+		avroConsumer, err := NewAvroConsumerWithSarama(consumerMock, schemaRegistryMock, "test", callbacks)
+		if err != nil {
+			t.Fatalf("%s: error creating consumer: %v", testCase.name, err)
+		}
+		done := make(chan struct{})
+		go func() {
+			avroConsumer.Consume()
+			close(done)
+		}()
+		select {
+		case msg := <-received:
+			if testCase.err {
+				t.Errorf("%s: expected an error, got %v", testCase.name, msg)
+			}
+			if msg.Value != testCase.value || len(msg.Headers) != len(testCase.headers) || msg.Headers["source"] != testCase.headers["source"] {
+				t.Errorf("%s: unexpected msg %v", testCase.name, msg)
+			}
+		case err := <-errs:
+			if !testCase.err {
+				t.Errorf("%s: unexpected error %v", testCase.name, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: no message dispatched", testCase.name)
+		}
+		avroConsumer.Close()
+		<-done
+		offsets := avroConsumer.consumer.(*saramaConsumer).offsets.Offsets()
+		if offsets["test-0"] != testCase.msg.Offset {
+			t.Errorf("%s: expected offset %d to be marked, got %v", testCase.name, testCase.msg.Offset, offsets)
+		}
+	}
+}
+
+func TestSaramaConsumer_CloseTwice(t *testing.T) {
+	consumerMock := mocks.NewConsumer(t, nil)
+	consumerMock.SetTopicMetadata(map[string][]int32{"test": {0}})
+	consumerMock.ExpectConsumePartition("test", 0, sarama.OffsetOldest)
+	avroConsumer, err := NewAvroConsumerWithSarama(consumerMock, nil, "test", ConsumerCallbacks{OnDataReceived: func(msg Message) {}})
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	source := avroConsumer.consumer.(*saramaConsumer)
+	if err := source.Close(); err != nil {
+		t.Errorf("Error closing consumer: %v", err)
+	}
+	if err := source.Close(); err != nil {
+		t.Errorf("Expected closing again to be a no-op, got %v", err)
+	}
+}
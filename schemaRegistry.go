@@ -2,45 +2,80 @@ package kafka
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/linkedin/goavro"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
 // SchemaRegistryClientInterface defines the api for all clients interfacing with schema registry
 type SchemaRegistryClientInterface interface {
 	GetSchema(int) (*goavro.Codec, error)
+	GetSchemaMetadata(int) (map[string]interface{}, error)
+	GetSchemaRaw(int) (json.RawMessage, error)
+	GetSubjectsBySchemaId(int) ([]string, error)
 	GetSubjects() ([]string, error)
 	GetVersions(string) ([]int, error)
 	GetSchemaByVersion(string, int) (*goavro.Codec, error)
+	GetAllVersions(string) (map[int]*goavro.Codec, error)
 	GetLatestSchema(string) (*goavro.Codec, error)
+	GetLatestSchemaId(string) (int, error)
 	CreateSubject(string, *goavro.Codec) (int, error)
 	IsSchemaRegistered(string, *goavro.Codec) (int, error)
 	DeleteSubject(string) error
 	DeleteVersion(string, int) error
+	GetReferencedBy(string, int) ([]int, error)
+	LookupSchemaUnderSubject(string, string) (int, int, error)
 }
 
-// SchemaRegistryClient is a basic http client to interact with schema registry
+// TokenProvider supplies bearer tokens for schema registries that require authentication
+type TokenProvider interface {
+	// Token returns the current token
+	Token() (string, error)
+	// Refresh renews the token after the schema registry rejected it
+	Refresh() error
+}
+
+// SchemaRegistryClient is a basic http client to interact with schema registry.
+// Servers are http(s) URLs or unix:// followed by the path of a unix domain socket, e.g. unix:///var/run/registry.sock
 type SchemaRegistryClient struct {
 	SchemaRegistryConnect []string
-	httpClient            *http.Client
-	retries               int
+	// TokenProvider authenticates requests with a bearer token, a 401 response refreshes the token once and retries
+	TokenProvider TokenProvider
+	// LogServers logs through Logger which registry server answered every request,
+	// e.g. to find a failover registry that serves stale schemas
+	LogServers bool
+	// OnSchemaFetched is called with every schema fetched from the registry, by id or by subject version,
+	// e.g. to keep an inventory of the schemas in use. The cached client only fetches schemas missing from its cache
+	OnSchemaFetched func(id int, schema string)
+	// PathPrefix is prepended to the path of every request, e.g. "/schema-registry" for a registry behind a gateway.
+	// Servers may include the path as well, trailing slashes of servers are ignored
+	PathPrefix string
+
+	httpClient  *http.Client
+	unixClients sync.Map
+	retries     int
 }
 
 type schemaResponse struct {
-	Schema string `json:"schema"`
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
 }
 
 type schemaVersionResponse struct {
-	Subject string `json:"subject"`
-	Version int    `json:"version"`
-	Schema  string `json:"schema"`
-	ID      int    `json:"id"`
+	Subject    string `json:"subject"`
+	Version    int    `json:"version"`
+	Schema     string `json:"schema"`
+	ID         int    `json:"id"`
+	SchemaType string `json:"schemaType,omitempty"`
 }
 
 type idResponse struct {
@@ -49,15 +84,23 @@ type idResponse struct {
 
 const (
 	schemaByID       = "/schemas/ids/%d"
+	subjectsByID     = "/schemas/ids/%d/subjects"
 	subjects         = "/subjects"
 	subjectVersions  = "/subjects/%s/versions"
 	deleteSubject    = "/subjects/%s"
 	subjectByVersion = "/subjects/%s/versions/%s"
+	referencedBy     = "/subjects/%s/versions/%d/referencedby"
 
 	latestVersion = "latest"
 
+	avroSchemaType = "AVRO"
+
 	contentType = "application/vnd.schemaregistry.v1+json"
 
+	unixScheme = "unix://"
+	// unixBaseURL is the url of requests over unix sockets, the host is ignored
+	unixBaseURL = "http://localhost"
+
 	timeout = 2 * time.Second
 )
 
@@ -67,7 +110,7 @@ func NewSchemaRegistryClient(connect []string) *SchemaRegistryClient {
 	client := &http.Client{
 		Timeout: timeout,
 	}
-	return &SchemaRegistryClient{connect, client, len(connect)}
+	return &SchemaRegistryClient{SchemaRegistryConnect: connect, httpClient: client, retries: len(connect)}
 }
 
 // NewSchemaRegistryClientWithRetries creates an http client with a configurable amount of retries on 5XX responses
@@ -75,10 +118,10 @@ func NewSchemaRegistryClientWithRetries(connect []string, retries int) *SchemaRe
 	client := &http.Client{
 		Timeout: timeout,
 	}
-	return &SchemaRegistryClient{connect, client, retries}
+	return &SchemaRegistryClient{SchemaRegistryConnect: connect, httpClient: client, retries: retries}
 }
 
-// GetSchema returns a goavro.Codec by unique id
+// GetSchema returns a goavro.Codec by unique id, schemas of another type than avro return an *ErrUnsupportedSchemaType
 func (client *SchemaRegistryClient) GetSchema(id int) (*goavro.Codec, error) {
 	resp, err := client.httpCall("GET", fmt.Sprintf(schemaByID, id), nil)
 	if nil != err {
@@ -88,7 +131,31 @@ func (client *SchemaRegistryClient) GetSchema(id int) (*goavro.Codec, error) {
 	if nil != err {
 		return nil, err
 	}
-	return goavro.NewCodec(schema.Schema)
+	client.schemaFetched(id, schema.Schema)
+	return newCodec(schema.Schema, schema.SchemaType)
+}
+
+// GetSchemaRaw returns the registry's response for the schema with the unique id as is,
+// e.g. to read fields like ruleSet or metadata of newer registries that the client doesn't model
+func (client *SchemaRegistryClient) GetSchemaRaw(id int) (json.RawMessage, error) {
+	resp, err := client.httpCall("GET", fmt.Sprintf(schemaByID, id), nil)
+	if nil != err {
+		return nil, err
+	}
+	return json.RawMessage(resp), nil
+}
+
+// GetSchemaMetadata returns the top level doc, namespace and custom attributes of the schema with the unique id
+func (client *SchemaRegistryClient) GetSchemaMetadata(id int) (map[string]interface{}, error) {
+	resp, err := client.httpCall("GET", fmt.Sprintf(schemaByID, id), nil)
+	if nil != err {
+		return nil, err
+	}
+	schema, err := parseSchema(resp)
+	if nil != err {
+		return nil, err
+	}
+	return parseSchemaMetadata(schema.Schema)
 }
 
 // GetSubjects returns a list of all subjects in the schema registry
@@ -114,6 +181,14 @@ func (client *SchemaRegistryClient) GetVersions(subject string) ([]int, error) {
 }
 
 func (client *SchemaRegistryClient) getSchemaByVersionInternal(subject string, version string) (*goavro.Codec, error) {
+	schema, err := client.getSchemaVersion(subject, version)
+	if nil != err {
+		return nil, err
+	}
+	return newCodec(schema.Schema, schema.SchemaType)
+}
+
+func (client *SchemaRegistryClient) getSchemaVersion(subject string, version string) (*schemaVersionResponse, error) {
 	resp, err := client.httpCall("GET", fmt.Sprintf(subjectByVersion, subject, version), nil)
 	if nil != err {
 		return nil, err
@@ -123,8 +198,8 @@ func (client *SchemaRegistryClient) getSchemaByVersionInternal(subject string, v
 	if nil != err {
 		return nil, err
 	}
-
-	return goavro.NewCodec(schema.Schema)
+	client.schemaFetched(schema.ID, schema.Schema)
+	return schema, nil
 }
 
 // GetSchemaByVersion returns a goavro.Codec for the version of the subject
@@ -132,6 +207,32 @@ func (client *SchemaRegistryClient) GetSchemaByVersion(subject string, version i
 	return client.getSchemaByVersionInternal(subject, fmt.Sprintf("%d", version))
 }
 
+// GetLatestSchemaId returns the id of the latest version of the subject
+func (client *SchemaRegistryClient) GetLatestSchemaId(subject string) (int, error) {
+	schema, err := client.getSchemaVersion(subject, latestVersion)
+	if nil != err {
+		return 0, err
+	}
+	return schema.ID, nil
+}
+
+// GetAllVersions returns the goavro.Codec of every version of the subject, keyed by version
+func (client *SchemaRegistryClient) GetAllVersions(subject string) (map[int]*goavro.Codec, error) {
+	versions, err := client.GetVersions(subject)
+	if err != nil {
+		return nil, err
+	}
+	codecs := make(map[int]*goavro.Codec, len(versions))
+	for _, version := range versions {
+		codec, err := client.GetSchemaByVersion(subject, version)
+		if err != nil {
+			return nil, err
+		}
+		codecs[version] = codec
+	}
+	return codecs, nil
+}
+
 // GetLatestSchema returns a goavro.Codec for the latest version of the subject
 func (client *SchemaRegistryClient) GetLatestSchema(subject string) (*goavro.Codec, error) {
 	return client.getSchemaByVersionInternal(subject, latestVersion)
@@ -139,7 +240,7 @@ func (client *SchemaRegistryClient) GetLatestSchema(subject string) (*goavro.Cod
 
 // CreateSubject adds a schema to the subject
 func (client *SchemaRegistryClient) CreateSubject(subject string, codec *goavro.Codec) (int, error) {
-	schema := schemaResponse{codec.Schema()}
+	schema := schemaResponse{Schema: codec.Schema()}
 	json, err := json.Marshal(schema)
 	if err != nil {
 		return 0, err
@@ -154,7 +255,7 @@ func (client *SchemaRegistryClient) CreateSubject(subject string, codec *goavro.
 
 // IsSchemaRegistered tests if the schema is registered, if so it returns the unique id of that schema
 func (client *SchemaRegistryClient) IsSchemaRegistered(subject string, codec *goavro.Codec) (int, error) {
-	schema := schemaResponse{codec.Schema()}
+	schema := schemaResponse{Schema: codec.Schema()}
 	json, err := json.Marshal(schema)
 	if err != nil {
 		return 0, err
@@ -179,12 +280,94 @@ func (client *SchemaRegistryClient) DeleteVersion(subject string, version int) e
 	return err
 }
 
+// GetReferencedBy returns the ids of the schemas that reference the version of the subject
+func (client *SchemaRegistryClient) GetReferencedBy(subject string, version int) ([]int, error) {
+	resp, err := client.httpCall("GET", fmt.Sprintf(referencedBy, subject, version), nil)
+	if nil != err {
+		return []int{}, err
+	}
+	var result = []int{}
+	err = json.Unmarshal(resp, &result)
+	return result, err
+}
+
+// GetSubjectsBySchemaId returns the subjects the schema with the unique id is registered under
+func (client *SchemaRegistryClient) GetSubjectsBySchemaId(id int) ([]string, error) {
+	resp, err := client.httpCall("GET", fmt.Sprintf(subjectsByID, id), nil)
+	if nil != err {
+		return []string{}, err
+	}
+	var result = []string{}
+	err = json.Unmarshal(resp, &result)
+	return result, err
+}
+
+// LookupSchemaUnderSubject returns the unique id and the version of the schema if it is registered under the subject
+func (client *SchemaRegistryClient) LookupSchemaUnderSubject(subject string, schema string) (int, int, error) {
+	json, err := json.Marshal(schemaResponse{Schema: schema})
+	if err != nil {
+		return 0, 0, err
+	}
+	payload := bytes.NewBuffer(json)
+	resp, err := client.httpCall("POST", fmt.Sprintf(deleteSubject, subject), payload)
+	if err != nil {
+		return 0, 0, err
+	}
+	version, err := parseSchemaVersion(resp)
+	if err != nil {
+		return 0, 0, err
+	}
+	return version.ID, version.Version, nil
+}
+
 func parseSchema(str []byte) (*schemaResponse, error) {
 	var schema = new(schemaResponse)
 	err := json.Unmarshal(str, &schema)
 	return schema, err
 }
 
+// newCodec creates the codec of an avro schema, registries only return a schema type for other types than avro
+func newCodec(schema string, schemaType string) (*goavro.Codec, error) {
+	if schemaType != "" && schemaType != avroSchemaType {
+		return nil, &ErrUnsupportedSchemaType{schemaType}
+	}
+	return goavro.NewCodec(schema)
+}
+
+// schemaStructureAttributes are the attributes describing the data, every other attribute is metadata
+var schemaStructureAttributes = map[string]bool{
+	"type":    true,
+	"name":    true,
+	"fields":  true,
+	"symbols": true,
+	"items":   true,
+	"values":  true,
+	"size":    true,
+}
+
+func parseSchemaMetadata(schema string) (map[string]interface{}, error) {
+	var attributes interface{}
+	if err := json.Unmarshal([]byte(schema), &attributes); err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]interface{})
+	// primitive and union schemas don't carry any metadata
+	if object, ok := attributes.(map[string]interface{}); ok {
+		for key, value := range object {
+			if !schemaStructureAttributes[key] {
+				metadata[key] = value
+			}
+		}
+	}
+	return metadata, nil
+}
+
+func parseSchemaVersion(str []byte) (*schemaVersionResponse, error) {
+	var version = new(schemaVersionResponse)
+	err := json.Unmarshal(str, &version)
+	return version, err
+}
+
 func parseID(str []byte) (int, error) {
 	var id = new(idResponse)
 	err := json.Unmarshal(str, &id)
@@ -192,19 +375,42 @@ func parseID(str []byte) (int, error) {
 }
 
 func (client *SchemaRegistryClient) httpCall(method, uri string, payload io.Reader) ([]byte, error) {
+	// keep the payload around, it has to be sent again on retries
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = ioutil.ReadAll(payload); err != nil {
+			return nil, err
+		}
+	}
 	nServers := len(client.SchemaRegistryConnect)
 	offset := rand.Intn(nServers)
+	refreshed := false
 	for i := 0; ; i++ {
-		url := fmt.Sprintf("%s%s", client.SchemaRegistryConnect[(i+offset)%nServers], uri)
-		req, err := http.NewRequest(method, url, payload)
+		server := client.SchemaRegistryConnect[(i+offset)%nServers]
+		httpClient, baseURL := client.httpClientFor(server)
+		url := fmt.Sprintf("%s%s%s", strings.TrimRight(baseURL, "/"), client.pathPrefix(), uri)
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
 		if err != nil {
 			return nil, err
 		}
 		req.Header.Set("Content-Type", contentType)
-		resp, err := client.httpClient.Do(req)
+		if err := client.authorize(req); err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
 		if resp != nil {
 			defer resp.Body.Close()
 		}
+		if err == nil && unauthorized(resp) && client.TokenProvider != nil && !refreshed {
+			// the token probably expired, refresh it and try the same server again without using up a retry
+			if err := client.TokenProvider.Refresh(); err != nil {
+				return nil, err
+			}
+			refreshed = true
+			i--
+			continue
+		}
 		if i < client.retries && (err != nil || retriable(resp)) {
 			continue
 		}
@@ -214,10 +420,67 @@ func (client *SchemaRegistryClient) httpCall(method, uri string, payload io.Read
 		if !okStatus(resp) {
 			return nil, newError(resp)
 		}
+		if client.LogServers {
+			Logger.Printf("%s %s served by %s", method, uri, server)
+		}
 		return ioutil.ReadAll(resp.Body)
 	}
 }
 
+func (client *SchemaRegistryClient) schemaFetched(id int, schema string) {
+	if client.OnSchemaFetched != nil {
+		client.OnSchemaFetched(id, schema)
+	}
+}
+
+// pathPrefix returns PathPrefix with a leading and without a trailing slash
+func (client *SchemaRegistryClient) pathPrefix() string {
+	prefix := strings.Trim(client.PathPrefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// httpClientFor returns the http client and base url of a server, unix sockets get a client of their own
+// so connections are never shared with another server
+func (client *SchemaRegistryClient) httpClientFor(server string) (*http.Client, string) {
+	socket := strings.TrimPrefix(server, unixScheme)
+	if socket == server {
+		return client.httpClient, server
+	}
+	if httpClient, ok := client.unixClients.Load(socket); ok {
+		return httpClient.(*http.Client), unixBaseURL
+	}
+	var dialer net.Dialer
+	httpClient := &http.Client{
+		Timeout: client.httpClient.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	actual, _ := client.unixClients.LoadOrStore(socket, httpClient)
+	return actual.(*http.Client), unixBaseURL
+}
+
+func (client *SchemaRegistryClient) authorize(req *http.Request) error {
+	if client.TokenProvider == nil {
+		return nil
+	}
+	token, err := client.TokenProvider.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func unauthorized(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized
+}
+
 func retriable(resp *http.Response) bool {
 	return resp.StatusCode >= 500 && resp.StatusCode < 600
 }
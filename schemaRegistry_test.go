@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/linkedin/goavro"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -24,7 +28,8 @@ func createSchemaRegistryTestObject(t *testing.T, subject string, id int) *TestO
 	testObject.Subject = subject
 	testObject.Id = id
 	testObject.Count = 0
-	codec, err := goavro.NewCodec(`{"type": "record", "name": "test", "fields" : [{"name": "val", "type": "int", "default": 0}]}`)
+	codec, err := goavro.NewCodec(`{"type": "record", "name": "test", "namespace": "test.ns", "doc": "test record", "owner": "team",
+		"fields" : [{"name": "val", "type": "int", "default": 0}]}`)
 	if err != nil {
 		t.Errorf("Could not create codec %v", err)
 	}
@@ -34,28 +39,36 @@ func createSchemaRegistryTestObject(t *testing.T, subject string, id int) *TestO
 		testObject.Count++
 		if r.Method == "POST" {
 			switch r.URL.String() {
-			case fmt.Sprintf(subjectVersions, subject), fmt.Sprintf(deleteSubject, subject):
+			case fmt.Sprintf(subjectVersions, subject):
 				response := idResponse{id}
 				str, _ := json.Marshal(response)
-				fmt.Fprintf(w, string(str))
+				fmt.Fprint(w, string(str))
+			case fmt.Sprintf(deleteSubject, subject):
+				response := schemaVersionResponse{Subject: subject, Version: 1, Schema: codec.Schema(), ID: id}
+				str, _ := json.Marshal(response)
+				fmt.Fprint(w, string(str))
 			}
 		} else if r.Method == "GET" {
 			switch r.URL.String() {
 			case fmt.Sprintf(schemaByID, id):
 				escapedSchema := strings.Replace(codec.Schema(), "\"", "\\\"", -1)
 				fmt.Fprintf(w, `{"schema": "%s"}`, escapedSchema)
-			case subjects:
+			case subjects, fmt.Sprintf(subjectsByID, id):
 				response := []string{subject}
 				str, _ := json.Marshal(response)
-				fmt.Fprintf(w, string(str))
+				fmt.Fprint(w, string(str))
 			case fmt.Sprintf(subjectVersions, subject):
 				response := []int{id}
 				str, _ := json.Marshal(response)
-				fmt.Fprintf(w, string(str))
+				fmt.Fprint(w, string(str))
 			case fmt.Sprintf(subjectByVersion, subject, "1"), fmt.Sprintf(subjectByVersion, subject, "latest"):
-				response := schemaVersionResponse{subject, 1, codec.Schema(), id}
+				response := schemaVersionResponse{Subject: subject, Version: 1, Schema: codec.Schema(), ID: id}
 				str, _ := json.Marshal(response)
-				fmt.Fprintf(w, string(str))
+				fmt.Fprint(w, string(str))
+			case fmt.Sprintf(referencedBy, subject, 1):
+				response := []int{id + 1}
+				str, _ := json.Marshal(response)
+				fmt.Fprint(w, string(str))
 			}
 		} else if r.Method == "DELETE" {
 			switch r.URL.String() {
@@ -98,7 +111,7 @@ func TestSchemaRegistryClient_Retries(t *testing.T) {
 			http.Error(w, `{"error_code": 500, "message": "Error in the backend datastore"}`, 500)
 		} else {
 			str, _ := json.Marshal(response)
-			fmt.Fprintf(w, string(str))
+			fmt.Fprint(w, string(str))
 		}
 	}))
 	SchemaRegistryClient := NewSchemaRegistryClientWithRetries([]string{mockServer.URL}, 2)
@@ -126,3 +139,150 @@ func TestSchemaRegistryClient_Error(t *testing.T) {
 		t.Errorf("Expected error to be %s, got %s", expectedErr.Error(), err.Error())
 	}
 }
+
+type testTokenProvider struct {
+	token     string
+	refreshes int
+}
+
+func (p *testTokenProvider) Token() (string, error) {
+	return p.token, nil
+}
+
+func (p *testTokenProvider) Refresh() error {
+	p.refreshes++
+	p.token = "fresh"
+	return nil
+}
+
+func TestSchemaRegistryClient_TokenRefresh(t *testing.T) {
+	response := []string{"test"}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, `{"error_code": 401, "message": "Unauthorized"}`, 401)
+			return
+		}
+		str, _ := json.Marshal(response)
+		fmt.Fprint(w, string(str))
+	}))
+	defer mockServer.Close()
+	tokenProvider := &testTokenProvider{token: "expired"}
+	SchemaRegistryClient := NewSchemaRegistryClientWithRetries([]string{mockServer.URL}, 0)
+	SchemaRegistryClient.TokenProvider = tokenProvider
+	subjects, err := SchemaRegistryClient.GetSubjects()
+	if err != nil {
+		t.Errorf("Found error %s", err)
+	}
+	if !reflect.DeepEqual(subjects, response) {
+		t.Errorf("Subjects did not match expected %s, got %s", response, subjects)
+	}
+	if tokenProvider.refreshes != 1 {
+		t.Errorf("Expected token to be refreshed once, got %d", tokenProvider.refreshes)
+	}
+}
+
+func TestSchemaRegistryClient_LogServers(t *testing.T) {
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error_code": 500, "message": "Error in the backend datastore"}`, 500)
+	}))
+	defer failingServer.Close()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `["test"]`)
+	}))
+	defer mockServer.Close()
+	logger := &testLogger{}
+	previous := Logger
+	defer func() { Logger = previous }()
+	Logger = logger
+	SchemaRegistryClient := NewSchemaRegistryClientWithRetries([]string{failingServer.URL, mockServer.URL}, 2)
+	SchemaRegistryClient.LogServers = true
+	if _, err := SchemaRegistryClient.GetSubjects(); err != nil {
+		t.Errorf("Found error %s", err)
+	}
+	if len(logger.lines) != 1 || !strings.HasSuffix(logger.lines[0], "served by "+mockServer.URL) {
+		t.Errorf("Expected the answering server to be logged, got %v", logger.lines)
+	}
+}
+
+func TestSchemaRegistryClient_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "registry.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Error listening on unix socket: %v", err)
+	}
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `["test"]`)
+	}))
+	mockServer.Listener = listener
+	mockServer.Start()
+	defer mockServer.Close()
+	SchemaRegistryClient := NewSchemaRegistryClient([]string{"unix://" + socket})
+	subjects, err := SchemaRegistryClient.GetSubjects()
+	if err != nil {
+		t.Errorf("Found error %s", err)
+	}
+	if !reflect.DeepEqual(subjects, []string{"test"}) {
+		t.Errorf("Subjects did not match expected [test], got %s", subjects)
+	}
+}
+
+func TestSchemaRegistryClient_GetSchemaRaw(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.String() == fmt.Sprintf(schemaByID, 1) {
+			fmt.Fprint(w, `{"schema": "\"string\"", "ruleSet": {"domainRules": [{"name": "checkLen"}]}}`)
+		}
+	}))
+	defer mockServer.Close()
+	SchemaRegistryClient := NewSchemaRegistryClient([]string{mockServer.URL})
+	raw, err := SchemaRegistryClient.GetSchemaRaw(1)
+	if err != nil {
+		t.Fatalf("Found error %s", err)
+	}
+	var response struct {
+		RuleSet struct {
+			DomainRules []struct {
+				Name string `json:"name"`
+			} `json:"domainRules"`
+		} `json:"ruleSet"`
+	}
+	if err := json.Unmarshal(raw, &response); err != nil {
+		t.Fatalf("Expected valid json, got %s", raw)
+	}
+	if len(response.RuleSet.DomainRules) != 1 || response.RuleSet.DomainRules[0].Name != "checkLen" {
+		t.Errorf("Expected the unmodeled fields to be kept, got %s", raw)
+	}
+}
+
+func TestSchemaRegistryClient_PathPrefix(t *testing.T) {
+	var paths []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, `["test"]`)
+	}))
+	defer mockServer.Close()
+	tests := []struct {
+		server string
+		prefix string
+	}{
+		{mockServer.URL, "/schema-registry"},
+		{mockServer.URL + "/", "schema-registry/"},
+		{mockServer.URL + "/schema-registry/", ""},
+	}
+	for _, test := range tests {
+		SchemaRegistryClient := NewSchemaRegistryClient([]string{test.server})
+		SchemaRegistryClient.PathPrefix = test.prefix
+		if _, err := SchemaRegistryClient.GetSubjects(); err != nil {
+			t.Errorf("Found error %s", err)
+		}
+	}
+	for _, path := range paths {
+		if path != "/schema-registry"+subjects {
+			t.Errorf("Expected the path to be prefixed once, got %s", path)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package kafka
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// interrupts fans out SIGINT to every running consumer, so a single signal shuts all of them down
+var interrupts = &signalBroadcaster{}
+
+// signalBroadcaster traps the signal once for the whole process instead of once per consumer
+type signalBroadcaster struct {
+	once        sync.Once
+	lock        sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+// subscribe returns a channel that is closed on the next interrupt and a func to unsubscribe
+func (b *signalBroadcaster) subscribe() (<-chan struct{}, func()) {
+	b.once.Do(b.listen)
+	ch := make(chan struct{})
+	b.lock.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan struct{}]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+	b.lock.Unlock()
+	return ch, func() {
+		b.lock.Lock()
+		delete(b.subscribers, ch)
+		b.lock.Unlock()
+	}
+}
+
+func (b *signalBroadcaster) listen() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			b.broadcast()
+		}
+	}()
+}
+
+func (b *signalBroadcaster) broadcast() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subscribers {
+		close(ch)
+		delete(b.subscribers, ch)
+	}
+}
+
+func (b *signalBroadcaster) count() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.subscribers)
+}
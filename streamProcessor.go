@@ -0,0 +1,137 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+)
+
+// StreamProcessor consumes a topic, transforms every record and produces the result to another topic
+type StreamProcessor struct {
+	SchemaRegistryClient *CachedSchemaRegistryClient
+	kafkaServers         []string
+	groupId              string
+	producer             sarama.SyncProducer
+
+	// OnError is called with the messages that fail to decode, with tombstones and with non-fatal consumer errors,
+	// the messages are skipped. Errors are logged through Logger when nil
+	OnError func(err error)
+}
+
+// NewStreamProcessor returns a processor that consumes as consumer group groupId
+func NewStreamProcessor(kafkaServers []string, schemaRegistryServers []string, groupId string) (*StreamProcessor, error) {
+	producer, err := sarama.NewSyncProducer(kafkaServers, newProducerConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &StreamProcessor{
+		SchemaRegistryClient: NewCachedSchemaRegistryClient(schemaRegistryServers),
+		kafkaServers:         kafkaServers,
+		groupId:              groupId,
+		producer:             producer,
+	}, nil
+}
+
+// ProcessAndForward passes every record of sourceTopic to transform and produces the returned native value
+// to destTopic, encoded with the latest schema of destSubject. Returning nil from transform drops the record.
+// The source offset is only marked once the destination acknowledged the record, so records are forwarded
+// at least once. Messages that fail to decode and tombstones are passed to OnError and skipped.
+// It blocks until interrupted and returns the first transform or produce error
+func (sp *StreamProcessor) ProcessAndForward(sourceTopic, destTopic, destSubject string,
+	transform func(msg Message) (interface{}, error)) error {
+	return sp.ProcessAndForwardContext(context.Background(), sourceTopic, destTopic, destSubject, transform)
+}
+
+// ProcessAndForwardContext is ProcessAndForward that also stops and returns nil once ctx is done
+func (sp *StreamProcessor) ProcessAndForwardContext(ctx context.Context, sourceTopic, destTopic, destSubject string,
+	transform func(msg Message) (interface{}, error)) error {
+	config := NewDefaultConfig()
+	config.Group.Return.Notifications = false
+	consumer, err := cluster.NewConsumer(sp.kafkaServers, sp.groupId, []string{sourceTopic}, config)
+	if err != nil {
+		return err
+	}
+	source := newAvroConsumer(consumer, sp.SchemaRegistryClient, ConsumerCallbacks{}, config)
+	defer source.Close()
+	return sp.forward(ctx, source, destTopic, destSubject, transform)
+}
+
+func (sp *StreamProcessor) forward(ctx context.Context, source *avroConsumer, destTopic, destSubject string,
+	transform func(msg Message) (interface{}, error)) error {
+	codec, err := sp.SchemaRegistryClient.GetLatestSchema(destSubject)
+	if err != nil {
+		return err
+	}
+	schemaId, err := sp.SchemaRegistryClient.IsSchemaRegistered(destSubject, codec)
+	if err != nil {
+		return err
+	}
+
+	interrupted, unsubscribe := interrupts.subscribe()
+	defer unsubscribe()
+
+	errs := source.consumer.Errors()
+	for {
+		select {
+		case m, ok := <-source.consumer.Messages():
+			if !ok {
+				return nil
+			}
+			msg, err := source.ProcessAvroMsg(m)
+			if err == nil && len(m.Value) == 0 {
+				err = &DecodeError{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Err: ErrTombstone}
+			}
+			if err != nil {
+				sp.reportError(err)
+				source.consumer.MarkOffset(m, "")
+				continue
+			}
+			native, err := transform(msg)
+			if err != nil {
+				return err
+			}
+			if native != nil {
+				binaryValue, err := codec.BinaryFromNative(nil, native)
+				if err != nil {
+					return err
+				}
+				_, _, err = sp.producer.SendMessage(&sarama.ProducerMessage{
+					Topic: destTopic,
+					Key:   sarama.ByteEncoder(m.Key),
+					Value: sarama.ByteEncoder(encodeAvroMsg(schemaId, binaryValue)),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			source.consumer.MarkOffset(m, "")
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+			} else if IsFatal(err) {
+				return err
+			} else {
+				sp.reportError(err)
+			}
+		case <-interrupted:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-source.ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (sp *StreamProcessor) reportError(err error) {
+	if sp.OnError != nil {
+		sp.OnError(err)
+		return
+	}
+	Logger.Printf("stream processor error: %s", err)
+}
+
+func (sp *StreamProcessor) Close() error {
+	return sp.producer.Close()
+}
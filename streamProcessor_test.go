@@ -0,0 +1,82 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func TestStreamProcessor_Forward(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	producerMock := mocks.NewSyncProducer(t, nil)
+	producerMock.ExpectSendMessageWithCheckerFunctionAndSucceed(func(value []byte) error {
+		msg, err := (&avroConsumer{SchemaRegistryClient: schemaRegistryMock}).ProcessAvroMsg(&sarama.ConsumerMessage{Value: value})
+		if err != nil {
+			return err
+		}
+		if msg.Value != `{"val":2}` {
+			return errors.New("unexpected value " + msg.Value)
+		}
+		return nil
+	})
+	processor := &StreamProcessor{SchemaRegistryClient: schemaRegistryMock, producer: producerMock}
+	defer processor.Close()
+	mockConsumer := newMockClusterConsumer()
+	source := newAvroConsumer(mockConsumer, schemaRegistryMock, ConsumerCallbacks{}, NewDefaultConfig())
+	mockConsumer.messages <- &sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec), Topic: "source", Offset: 3}
+	mockConsumer.messages <- &sarama.ConsumerMessage{Value: getTestAvroMsg(t, schemaRegistryTestObject.Codec), Topic: "source", Offset: 4}
+	forwarded := false
+	transformErr := errors.New("transform failed")
+	err := processor.forward(context.Background(), source, "dest", "test", func(msg Message) (interface{}, error) {
+		if msg.Offset == 4 {
+			return nil, transformErr
+		}
+		forwarded = true
+		return map[string]interface{}{"val": 2}, nil
+	})
+	if err != transformErr {
+		t.Errorf("Expected the transform error to stop forwarding, got %v", err)
+	}
+	if !forwarded || len(mockConsumer.marked) != 1 || mockConsumer.marked[0].Offset != 3 {
+		t.Errorf("Expected only the forwarded offset to be marked, got %v", mockConsumer.marked)
+	}
+}
+
+func TestStreamProcessor_ForwardSkipsUndecodable(t *testing.T) {
+	schemaRegistryTestObject := createSchemaRegistryTestObject(t, "test", 1)
+	schemaRegistryMock := NewCachedSchemaRegistryClient([]string{schemaRegistryTestObject.MockServer.URL})
+	var skipped []error
+	processor := &StreamProcessor{
+		SchemaRegistryClient: schemaRegistryMock,
+		producer:             mocks.NewSyncProducer(t, nil),
+		OnError:              func(err error) { skipped = append(skipped, err) },
+	}
+	defer processor.Close()
+	mockConsumer := newMockClusterConsumer()
+	source := newAvroConsumer(mockConsumer, schemaRegistryMock, ConsumerCallbacks{}, NewDefaultConfig())
+	mockConsumer.messages <- &sarama.ConsumerMessage{Value: []byte{0, 0}, Topic: "source", Offset: 3}
+	mockConsumer.messages <- &sarama.ConsumerMessage{Topic: "source", Offset: 4}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := processor.forward(ctx, source, "dest", "test", func(msg Message) (interface{}, error) {
+		t.Errorf("Expected offset %d not to be transformed", msg.Offset)
+		return nil, nil
+	})
+	if err != nil {
+		t.Errorf("Expected forwarding to stop without error once ctx is done, got %v", err)
+	}
+	if len(skipped) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", skipped)
+	}
+	if decodeErr, ok := skipped[1].(*DecodeError); !ok || decodeErr.Err != ErrTombstone {
+		t.Errorf("Expected ErrTombstone, got %v", skipped[1])
+	}
+	if len(mockConsumer.marked) != 2 || mockConsumer.marked[1].Offset != 4 {
+		t.Errorf("Expected the skipped offsets to be marked, got %v", mockConsumer.marked)
+	}
+}